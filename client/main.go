@@ -1,30 +1,198 @@
 package main
 
 import (
-	"github.com/loganmhb/ktcoin/ktcoin"
+	"errors"
 	"flag"
 	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/loganmhb/ktcoin/ktcoin"
 )
 
+// The recipients given with -to, each either "address:amount" or just
+// "address" to send the -amount given on the command line.
+type recipientList []string
+
+func (r *recipientList) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *recipientList) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+func parsePayments(recipients recipientList, defaultAmount int) ([]ktcoin.Payment, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients given")
+	}
+
+	payments := make([]ktcoin.Payment, 0, len(recipients))
+	for _, recipient := range recipients {
+		addressString := recipient
+		amount := defaultAmount
+		if i := strings.LastIndex(recipient, ":"); i >= 0 {
+			addressString = recipient[:i]
+			parsed, err := strconv.Atoi(recipient[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid amount for %s: %v", addressString, err)
+			}
+			amount = parsed
+		}
+
+		address, err := ktcoin.ParseAddress(addressString)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, ktcoin.Payment{Recipient: address, Amount: amount})
+	}
+	return payments, nil
+}
+
+// Runs one of the wallet commands, which don't need a node.
+func walletCommand(wallet *ktcoin.Wallet, command string, args []string) error {
+	switch command {
+	case "keys":
+		for _, k := range wallet.Keys() {
+			fmt.Printf("%s\t%s\tcreated %s\n", k.Label, k.Address(), k.Created.Format("2006-01-02 15:04:05"))
+		}
+		return nil
+	case "newkey":
+		if len(args) > 1 {
+			return errors.New("usage: newkey [label]")
+		}
+		label := ""
+		if len(args) == 1 {
+			label = args[0]
+		}
+		k, err := wallet.NewKey(label)
+		if err != nil {
+			return err
+		}
+		err = wallet.Save()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("New key %s; give out its address to be paid: %s\n", k.Label, k.Address())
+		return nil
+	case "import":
+		if len(args) != 2 {
+			return errors.New("usage: import <label> <keyfile>")
+		}
+		_, err := wallet.Import(args[0], args[1], ktcoin.PromptPassphrase("Passphrase for "+args[1]+": "))
+		if err != nil {
+			return err
+		}
+		return wallet.Save()
+	case "export":
+		if len(args) != 2 {
+			return errors.New("usage: export <label> <keyfile>")
+		}
+		return wallet.Export(args[0], args[1])
+	case "encrypt":
+		if wallet.Encrypted() {
+			return errors.New("the wallet is already encrypted")
+		}
+		return wallet.Save()
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
 func main() {
-	senderKeyFile := flag.String("key", "id_rsa", "File of the sender's private key")
-	recipientKeyFile := flag.String("to", "", "File of the recipient's public key")
-	generateKey := flag.Bool("generate", false, "Generate a new private key")
-	amount := flag.Int("amount", 0, "Amount to send")
+	var recipients recipientList
+	node := flag.String("node", ktcoin.DefaultNodeAddress, "Address of the node to send requests to")
+	walletFile := flag.String("wallet", "wallet.json", "File of the wallet's keys")
+	flag.Var(&recipients, "to", "Recipient address, optionally followed by :amount (may be repeated)")
+	amount := flag.Int("amount", 0, "Amount to send to recipients given without an amount")
+	fee := flag.Int("fee", 0, "Fee to pay the miner of the transaction")
+	selection := flag.String("select", ktcoin.DefaultCoinSelector, "How to choose the outputs to spend: largest-first, branch-and-bound or smallest-sufficient")
+	listPeers := flag.Bool("peers", false, "List the local node's peers instead of sending a transaction")
+	addPeer := flag.String("addpeer", "", "Add a peer address to the local node instead of sending a transaction")
+	removePeer := flag.String("removepeer", "", "Remove a peer address from the local node instead of sending a transaction")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintln(out, "usage: client [flags] [command]")
+		fmt.Fprintln(out, "commands:")
+		fmt.Fprintln(out, "  send                     send coins to the -to recipients (the default)")
+		fmt.Fprintln(out, "  balance                  show the balance of each key in the wallet")
+		fmt.Fprintln(out, "  keys                     list the wallet's keys and their addresses")
+		fmt.Fprintln(out, "  newkey [label]           add a new key to receive coins with")
+		fmt.Fprintln(out, "  import <label> <keyfile> add a private key file to the wallet")
+		fmt.Fprintln(out, "  export <label> <keyfile> write a wallet key to keyfile and keyfile.pub")
+		fmt.Fprintln(out, "  encrypt [keyfile ...]    encrypt plaintext key files, or the wallet if none are given")
+		fmt.Fprintln(out, "  genkey <keyfile>         generate a node's key in keyfile and keyfile.pub")
+		fmt.Fprintln(out, "Passphrases are read from $"+ktcoin.PassphraseEnv+" if it's set.")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	if *generateKey {
-		ktcoin.GenerateKey(*senderKeyFile)
+	if *listPeers || *addPeer != "" || *removePeer != "" {
+		var err error
+		switch {
+		case *addPeer != "":
+			err = ktcoin.AddPeer(*node, *addPeer)
+		case *removePeer != "":
+			err = ktcoin.RemovePeer(*node, *removePeer)
+		default:
+			err = ktcoin.ListPeers(*node)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
 	}
-	senderKey, err := ktcoin.LoadKey(*senderKeyFile)
-	if err != nil {
-		fmt.Println(err)
+
+	command := "send"
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+	}
+	if command == "genkey" {
+		if flag.NArg() != 2 {
+			fmt.Println("usage: genkey <keyfile>")
+			return
+		}
+		keyFile := flag.Arg(1)
+		err := ktcoin.GenerateKey(keyFile, ktcoin.PromptNewPassphrase("New passphrase for "+keyFile+": "))
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	if command == "encrypt" && flag.NArg() > 1 {
+		for _, keyFile := range flag.Args()[1:] {
+			err := ktcoin.EncryptKeyFile(keyFile, ktcoin.PromptNewPassphrase("New passphrase for "+keyFile+": "))
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+		return
 	}
-	recipientKey, err := ktcoin.LoadPublicKey(*recipientKeyFile)
+
+	wallet, err := ktcoin.OpenWallet(*walletFile,
+		ktcoin.PromptPassphrase("Wallet passphrase: "),
+		ktcoin.PromptNewPassphrase("New wallet passphrase: "))
 	if err != nil {
 		fmt.Println(err)
+		return
+	}
+
+	switch command {
+	case "send":
+		var payments []ktcoin.Payment
+		var selector ktcoin.CoinSelector
+		payments, err = parsePayments(recipients, *amount)
+		if err == nil {
+			selector, err = ktcoin.CoinSelectorByName(*selection)
+		}
+		if err == nil {
+			err = ktcoin.SendTransaction(*node, wallet, payments, *fee, selector)
+		}
+	case "balance":
+		err = ktcoin.WalletBalance(*node, wallet)
+	default:
+		err = walletCommand(wallet, command, flag.Args()[1:])
 	}
-	err = ktcoin.SendTransaction(senderKey, recipientKey, *amount)
 	if err != nil {
 		fmt.Println(err)
 	}
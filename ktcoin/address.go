@@ -0,0 +1,118 @@
+package ktcoin
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// An Address identifies the owner of an output: the first 20 bytes of
+// the SHA-256 hash of their PKIX-encoded public key.  The key itself
+// only appears once the output is spent, when its owner signs for it.
+type Address [20]byte
+
+// The byte written before the hash in an address's text form, which
+// marks it as a ktcoin address.  Every address starts with "K".
+const AddressVersion = 0x2d
+
+// Returns the address of the owner of a public key.
+func AddressFromKey(key rsa.PublicKey) Address {
+	var address Address
+	if key.N == nil {
+		return address
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key)
+	if err != nil {
+		return address
+	}
+	hash := sha256.Sum256(der)
+	copy(address[:], hash[:])
+	return address
+}
+
+// The text form of an address is base58check: the version byte, the
+// hash and the first four bytes of the double SHA-256 of both, encoded
+// in base 58.
+func (a Address) String() string {
+	payload := append([]byte{AddressVersion}, a[:]...)
+	return base58Encode(append(payload, addressChecksum(payload)...))
+}
+
+// Parses an address in the text form written by String, checking its
+// version and checksum so that a mistyped address is caught before
+// anything is sent to it.
+func ParseAddress(s string) (Address, error) {
+	var address Address
+	data, err := base58Decode(s)
+	if err != nil {
+		return address, err
+	}
+	if len(data) != 1+len(address)+4 {
+		return address, fmt.Errorf("address %q has the wrong length", s)
+	}
+	payload, checksum := data[:len(data)-4], data[len(data)-4:]
+	if !bytes.Equal(addressChecksum(payload), checksum) {
+		return address, fmt.Errorf("address %q has a bad checksum", s)
+	}
+	if payload[0] != AddressVersion {
+		return address, fmt.Errorf("address %q is not a ktcoin address", s)
+	}
+	copy(address[:], payload[1:])
+	return address, nil
+}
+
+func addressChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var big58 = big.NewInt(58)
+
+// Encodes data in base 58.  Each leading zero byte becomes a leading
+// "1", so that no bytes are lost.
+func base58Encode(data []byte) string {
+	n := new(big.Int).SetBytes(data)
+	digits := make([]byte, 0, len(data)*138/100+1)
+	mod := new(big.Int)
+	for n.Sign() > 0 {
+		n.DivMod(n, big58, mod)
+		digits = append(digits, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		digits = append(digits, base58Alphabet[0])
+	}
+	for i, j := 0, len(digits)-1; i < j; i, j = i+1, j-1 {
+		digits[i], digits[j] = digits[j], digits[i]
+	}
+	return string(digits)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("empty address")
+	}
+	n := new(big.Int)
+	for _, c := range []byte(s) {
+		digit := bytes.IndexByte([]byte(base58Alphabet), c)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid character %q in address", c)
+		}
+		n.Mul(n, big58)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
@@ -0,0 +1,69 @@
+package ktcoin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+)
+
+func TestAddressRoundTrip(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	address := AddressFromKey(key.PublicKey)
+	s := address.String()
+	if len(s) != 34 || s[0] != 'K' {
+		t.Errorf("unexpected address form %q", s)
+	}
+	parsed, err := ParseAddress(s)
+	if err != nil || parsed != address {
+		t.Fatal("address didn't survive a round trip:", s, err)
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if AddressFromKey(other.PublicKey) == address {
+		t.Error("two keys have the same address")
+	}
+}
+
+func TestParseAddressRejectsTypos(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	s := AddressFromKey(key.PublicKey).String()
+
+	// Changing any one character is caught by the checksum.
+	for i := range s {
+		replacement := "2"
+		if s[i] == '2' {
+			replacement = "3"
+		}
+		typo := s[:i] + replacement + s[i+1:]
+		if _, err := ParseAddress(typo); err == nil {
+			t.Errorf("accepted %q with a typo at %d", typo, i)
+		}
+	}
+
+	// The same hash with another version byte isn't a ktcoin address.
+	address := AddressFromKey(key.PublicKey)
+	payload := append([]byte{0}, address[:]...)
+	bitcoinStyle := base58Encode(append(payload, addressChecksum(payload)...))
+	if _, err := ParseAddress(bitcoinStyle); err == nil || !strings.Contains(err.Error(), "not a ktcoin address") {
+		t.Error("accepted an address with the wrong version:", err)
+	}
+
+	for _, bad := range []string{"", s[:len(s)-1], s + "1", "K0OIl" + s[5:]} {
+		if _, err := ParseAddress(bad); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestBase58LeadingZeros(t *testing.T) {
+	data := []byte{0, 0, 1, 2, 3}
+	s := base58Encode(data)
+	if !strings.HasPrefix(s, "11") {
+		t.Errorf("leading zeros not kept: %q", s)
+	}
+	decoded, err := base58Decode(s)
+	if err != nil || string(decoded) != string(data) {
+		t.Errorf("decoded %x, want %x", decoded, data)
+	}
+}
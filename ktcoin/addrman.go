@@ -0,0 +1,260 @@
+package ktcoin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The port nodes listen on when an address doesn't give one.
+const DefaultPort = "8000"
+
+// The file in the data directory where peer addresses are saved.
+const peerFileName = "peers.json"
+
+// The most peer addresses a node remembers.
+const MaxKnownAddresses = 1000
+
+// A peer that has failed this many times in a row is forgotten.
+const MaxAddressFailures = 10
+
+// How long to wait before retrying a peer after its first failure.
+// The wait doubles with each further failure, up to MaxRetryInterval.
+const (
+	BaseRetryInterval = 10 * time.Second
+	MaxRetryInterval  = time.Hour
+)
+
+// A peer address along with how reliable it's been.
+type KnownAddress struct {
+	Address     string
+	LastSeen    time.Time
+	LastAttempt time.Time
+	Failures    int
+}
+
+// Returns when we may next try to connect to the address.
+func (ka *KnownAddress) nextAttempt() time.Time {
+	return ka.LastAttempt.Add(retryInterval(ka.Failures))
+}
+
+// How long to wait before connecting to a peer again after it's failed
+// the given number of times in a row.
+func retryInterval(failures int) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	if failures > 32 || BaseRetryInterval<<uint(failures-1) > MaxRetryInterval {
+		return MaxRetryInterval
+	}
+	return BaseRetryInterval << uint(failures-1)
+}
+
+// The AddrManager keeps the table of peers a node knows about, which
+// grows as peers share their own tables with us.  The table is bounded:
+// when it's full, the least reliable address makes room for a new one.
+// It's saved to path so that a node can find its peers again after a
+// restart.  Unlike the block chain, the table is used by the goroutines
+// that talk to peers, so it has its own lock.
+type AddrManager struct {
+	mu    sync.Mutex
+	path  string
+	addrs map[string]*KnownAddress
+	limit int
+	dirty bool
+}
+
+func NewAddrManager(path string, limit int) *AddrManager {
+	return &AddrManager{path: path, addrs: make(map[string]*KnownAddress), limit: limit}
+}
+
+// Loads the table saved at the manager's path, if there is one.
+func (am *AddrManager) Load() error {
+	data, err := ioutil.ReadFile(am.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []KnownAddress
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for i := range saved {
+		ka := saved[i]
+		addr, err := normalizeAddress(ka.Address)
+		if err != nil {
+			continue
+		}
+		ka.Address = addr
+		am.insert(&ka)
+	}
+	return nil
+}
+
+// Saves the table if it's changed since it was last saved.  The new
+// table is written beside the old one and renamed over it, so a crash
+// never leaves a half-written file.
+func (am *AddrManager) Flush() error {
+	am.mu.Lock()
+	if !am.dirty || am.path == "" {
+		am.mu.Unlock()
+		return nil
+	}
+	saved := am.list()
+	am.dirty = false
+	am.mu.Unlock()
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := am.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, am.path)
+}
+
+// Adds an address to the table, in host or host:port form.  Returns
+// the address as it's stored.
+func (am *AddrManager) Add(address string) (string, error) {
+	addr, err := normalizeAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if _, ok := am.addrs[addr]; !ok {
+		am.insert(&KnownAddress{Address: addr})
+	}
+	return addr, nil
+}
+
+func (am *AddrManager) insert(ka *KnownAddress) {
+	if len(am.addrs) >= am.limit {
+		am.evict()
+	}
+	am.addrs[ka.Address] = ka
+	am.dirty = true
+}
+
+// Forgets the address that's failed the most times, or, among
+// addresses that have failed equally often, the one seen longest ago.
+func (am *AddrManager) evict() {
+	var worst *KnownAddress
+	for _, ka := range am.addrs {
+		if worst == nil || ka.Failures > worst.Failures ||
+			(ka.Failures == worst.Failures && ka.LastSeen.Before(worst.LastSeen)) {
+			worst = ka
+		}
+	}
+	if worst != nil {
+		delete(am.addrs, worst.Address)
+	}
+}
+
+func (am *AddrManager) Remove(address string) error {
+	addr, err := normalizeAddress(address)
+	if err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if _, ok := am.addrs[addr]; ok {
+		delete(am.addrs, addr)
+		am.dirty = true
+	}
+	return nil
+}
+
+// Records a successful connection to an address.
+func (am *AddrManager) Good(addr string) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if ka, ok := am.addrs[addr]; ok {
+		ka.LastSeen = time.Now()
+		ka.LastAttempt = ka.LastSeen
+		ka.Failures = 0
+		am.dirty = true
+	}
+}
+
+// Records a failed connection to an address, forgetting it if it's
+// failed too many times in a row.
+func (am *AddrManager) Failed(addr string) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if ka, ok := am.addrs[addr]; ok {
+		ka.LastAttempt = time.Now()
+		ka.Failures++
+		if ka.Failures >= MaxAddressFailures {
+			delete(am.addrs, addr)
+		}
+		am.dirty = true
+	}
+}
+
+// Returns the addresses we may try to connect to now, leaving out
+// those still waiting out their backoff after failing.
+func (am *AddrManager) Candidates(now time.Time) []string {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	candidates := make([]string, 0, len(am.addrs))
+	for addr, ka := range am.addrs {
+		if !now.Before(ka.nextAttempt()) {
+			candidates = append(candidates, addr)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// Returns every address in the table, for sharing with peers.
+func (am *AddrManager) Addresses() []string {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	addrs := make([]string, 0, len(am.addrs))
+	for addr := range am.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (am *AddrManager) list() []KnownAddress {
+	saved := make([]KnownAddress, 0, len(am.addrs))
+	for _, ka := range am.addrs {
+		saved = append(saved, *ka)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Address < saved[j].Address })
+	return saved
+}
+
+// Puts an address in host:port form, adding the default port if it
+// has none, so that the same peer is always stored the same way.
+func normalizeAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ""
+	}
+	if port == "" {
+		port = DefaultPort
+	}
+	if host == "" {
+		return "", &net.AddrError{Err: "missing host", Addr: address}
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,112 @@
+package ktcoin
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	cases := map[string]string{
+		"node1":          "node1:8000",
+		"node1:9000":     "node1:9000",
+		"10.0.0.1":       "10.0.0.1:8000",
+		"10.0.0.1:":      "10.0.0.1:8000",
+		"[::1]:9000":     "[::1]:9000",
+		"::1":            "[::1]:8000",
+		"example.com:80": "example.com:80",
+	}
+	for in, expected := range cases {
+		addr, err := normalizeAddress(in)
+		if err != nil || addr != expected {
+			t.Errorf("%q: got %q (%v), want %q", in, addr, err, expected)
+		}
+	}
+	if _, err := normalizeAddress(":9000"); err == nil {
+		t.Error("accepted an address with no host")
+	}
+}
+
+func TestAddrManagerBounded(t *testing.T) {
+	am := NewAddrManager("", 2)
+	am.Add("a")
+	am.Add("b")
+	am.Good("a:8000")
+	am.Failed("b:8000")
+	am.Add("c")
+
+	addrs := am.Addresses()
+	if len(addrs) != 2 || addrs[0] != "a:8000" || addrs[1] != "c:8000" {
+		t.Error("expected the failing address to make room:", addrs)
+	}
+
+	for i := 0; i < MaxAddressFailures; i++ {
+		am.Failed("c:8000")
+	}
+	if addrs := am.Addresses(); len(addrs) != 1 {
+		t.Error("kept an address that keeps failing:", addrs)
+	}
+}
+
+func TestAddrManagerBackoff(t *testing.T) {
+	am := NewAddrManager("", 10)
+	am.Add("a")
+	am.Add("b")
+	now := time.Now()
+	if len(am.Candidates(now)) != 2 {
+		t.Fatal("new addresses should be tried straight away")
+	}
+
+	am.Failed("a:8000")
+	candidates := am.Candidates(now)
+	if len(candidates) != 1 || candidates[0] != "b:8000" {
+		t.Error("retried a failed address too soon:", candidates)
+	}
+	if len(am.Candidates(now.Add(BaseRetryInterval+time.Second))) != 2 {
+		t.Error("failed address was not retried after its backoff")
+	}
+
+	am.Failed("a:8000")
+	if len(am.Candidates(now.Add(BaseRetryInterval+time.Second))) != 1 {
+		t.Error("backoff did not grow after a second failure")
+	}
+
+	am.Good("a:8000")
+	if len(am.Candidates(time.Now())) != 2 {
+		t.Error("backoff was not reset by a successful connection")
+	}
+}
+
+func TestAddrManagerPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), peerFileName)
+	am := NewAddrManager(path, 10)
+	am.Add("a")
+	am.Add("b:9000")
+	am.Good("a:8000")
+	am.Remove("b:9000")
+	am.Add("c")
+	am.Failed("c:8000")
+	if err := am.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewAddrManager(path, 10)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	addrs := loaded.Addresses()
+	if len(addrs) != 2 || addrs[0] != "a:8000" || addrs[1] != "c:8000" {
+		t.Fatal("wrong addresses after reloading:", addrs)
+	}
+	if c := loaded.addrs["c:8000"]; c.Failures != 1 {
+		t.Error("failure count was not saved")
+	}
+	if a := loaded.addrs["a:8000"]; a.LastSeen.IsZero() {
+		t.Error("last seen time was not saved")
+	}
+
+	// Loading a missing table is not an error.
+	if err := NewAddrManager(path+".missing", 10).Load(); err != nil {
+		t.Error(err)
+	}
+}
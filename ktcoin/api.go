@@ -0,0 +1,424 @@
+package ktcoin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The largest request body the HTTP API will read.
+const maxAPIRequestSize = 1 << 20
+
+// How long a client of the HTTP API has to send a request's headers,
+// and how long the API has to answer it.  Every request waits its turn
+// on the request loop, so a slow client mustn't hold a connection
+// forever.
+const (
+	apiReadHeaderTimeout = 10 * time.Second
+	apiWriteTimeout      = 30 * time.Second
+)
+
+// The HTTP API serves the same information as the RPC interface as
+// JSON, for programs that don't speak Go's net/rpc.  Hashes, public
+// keys and signatures are hex-encoded, and addresses are in their
+// base58 text form.  Every endpoint is under /api:
+//
+//	GET  /api/tip                   the tip of the main chain
+//	GET  /api/blocks/<hash>         a block by hash
+//	GET  /api/blocks/height/<n>     a block on the main chain by height
+//	GET  /api/transactions/<hash>   a mined or pending transaction
+//	POST /api/transactions          submit {"hex": "<canonical encoding>"}
+//	GET  /api/addresses/<addr>/balance  the total an address can spend
+//	GET  /api/addresses/<addr>/inputs   the open outputs paid to it that
+//	                                    no pending transaction spends
+//	GET  /api/mempool               transactions waiting to be mined
+//	GET  /api/peers                 the peers we've connected to
+//
+// Errors are returned with an appropriate status code and a body of
+// {"error": {"code": "...", "message": "..."}}.
+type apiHandler struct {
+	server *BlockChainServer
+}
+
+func NewAPIHandler(server *BlockChainServer) http.Handler {
+	return &apiHandler{server}
+}
+
+// Returns an HTTP server for the API listening on addr.
+func NewAPIServer(addr string, server *BlockChainServer) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           NewAPIHandler(server),
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+		WriteTimeout:      apiWriteTimeout,
+	}
+}
+
+type apiError struct {
+	status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func notFound(format string, args ...interface{}) *apiError {
+	return &apiError{http.StatusNotFound, "not_found", fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...interface{}) *apiError {
+	return &apiError{http.StatusBadRequest, "bad_request", fmt.Sprintf(format, args...)}
+}
+
+// Runs a query against the server's state from the request loop, like
+// every other request, and returns its result.
+type apiQuery struct {
+	query           func(server *BlockChainServer) (interface{}, error)
+	callbackChannel chan apiResult
+}
+
+type apiResult struct {
+	value interface{}
+	err   error
+}
+
+func (q apiQuery) rpcHandle(server *BlockChainServer) {
+	value, err := q.query(server)
+	q.callbackChannel <- apiResult{value, err}
+}
+
+func (h *apiHandler) run(query func(server *BlockChainServer) (interface{}, error)) (interface{}, error) {
+	cb := make(chan apiResult)
+	h.server.requests <- apiQuery{query, cb}
+	result := <-cb
+	return result.value, result.err
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+	parts := strings.Split(path, "/")
+
+	var value interface{}
+	var err error
+	switch {
+	case r.Method == http.MethodPost && path == "transactions":
+		value, err = h.submitTransaction(w, r.Body)
+	case r.Method != http.MethodGet:
+		err = &apiError{http.StatusMethodNotAllowed, "method_not_allowed", r.Method + " is not supported here"}
+	case path == "tip":
+		value, err = h.run(apiTip)
+	case len(parts) == 3 && parts[0] == "blocks" && parts[1] == "height":
+		value, err = h.blockAtHeight(parts[2])
+	case len(parts) == 2 && parts[0] == "blocks":
+		value, err = h.block(parts[1])
+	case len(parts) == 2 && parts[0] == "transactions":
+		value, err = h.transaction(parts[1])
+	case len(parts) == 3 && parts[0] == "addresses" && (parts[2] == "balance" || parts[2] == "inputs"):
+		value, err = h.openInputs(parts[1], parts[2] == "balance")
+	case path == "mempool":
+		value, err = h.run(apiMempool)
+	case path == "peers":
+		value, err = h.run(func(server *BlockChainServer) (interface{}, error) {
+			peers := make([]peerJSON, 0, len(server.peers))
+			for _, info := range sortedPeers(server.peers) {
+				peers = append(peers, newPeerJSON(info))
+			}
+			return peers, nil
+		})
+	default:
+		err = notFound("no such endpoint: %s", r.URL.Path)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		apiErr, ok := err.(*apiError)
+		if !ok {
+			apiErr = &apiError{http.StatusInternalServerError, "internal", err.Error()}
+		}
+		w.WriteHeader(apiErr.status)
+		value = map[string]*apiError{"error": apiErr}
+	}
+	json.NewEncoder(w).Encode(value)
+}
+
+func parseSHA(s string) (SHA, error) {
+	var sha SHA
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(sha) {
+		return sha, badRequest("invalid hash %q", s)
+	}
+	copy(sha[:], b)
+	return sha, nil
+}
+
+type tipJSON struct {
+	Hash   string `json:"hash"`
+	Height int    `json:"height"`
+	Work   string `json:"work"`
+}
+
+func apiTip(server *BlockChainServer) (interface{}, error) {
+	tip, height := server.blockchain.Tip()
+	return tipJSON{tip.String(), height, server.blockchain.index[tip].work.String()}, nil
+}
+
+func (h *apiHandler) block(hash string) (interface{}, error) {
+	sha, err := parseSHA(hash)
+	if err != nil {
+		return nil, err
+	}
+	return h.run(func(server *BlockChainServer) (interface{}, error) {
+		block, ok := server.blockchain.blocks[sha]
+		if !ok {
+			return nil, notFound("no block %s", hash)
+		}
+		return newBlockJSON(server.blockchain, &block), nil
+	})
+}
+
+func (h *apiHandler) blockAtHeight(height string) (interface{}, error) {
+	n, err := strconv.Atoi(height)
+	if err != nil {
+		return nil, badRequest("invalid height %q", height)
+	}
+	return h.run(func(server *BlockChainServer) (interface{}, error) {
+		block, err := server.blockchain.BlockAt(n)
+		if err != nil {
+			return nil, notFound("%v", err)
+		}
+		return newBlockJSON(server.blockchain, block), nil
+	})
+}
+
+type minedTransactionJSON struct {
+	Transaction   txJSON `json:"transaction"`
+	Block         string `json:"block,omitempty"`
+	Confirmations int    `json:"confirmations"`
+	Pending       bool   `json:"pending"`
+}
+
+func (h *apiHandler) transaction(hash string) (interface{}, error) {
+	sha, err := parseSHA(hash)
+	if err != nil {
+		return nil, err
+	}
+	return h.run(func(server *BlockChainServer) (interface{}, error) {
+		bc := server.blockchain
+		if blockSha, ok := bc.txIndex[sha]; ok {
+			block := bc.blocks[blockSha]
+			for i := range block.Transactions {
+				if block.Transactions[i].Hash() == sha {
+					return minedTransactionJSON{newTxJSON(&block.Transactions[i]), blockSha.String(), bc.Confirmations(sha), false}, nil
+				}
+			}
+		}
+		if tx := server.mempool.Get(sha); tx != nil {
+			return minedTransactionJSON{newTxJSON(tx), "", 0, true}, nil
+		}
+		return nil, notFound("no transaction %s", hash)
+	})
+}
+
+type inputJSON struct {
+	Hash   string `json:"hash"`
+	Index  uint32 `json:"index"`
+	Amount int    `json:"amount,omitempty"`
+}
+
+type balanceJSON struct {
+	Address string `json:"address"`
+	Balance int    `json:"balance"`
+}
+
+func (h *apiHandler) openInputs(addressString string, total bool) (interface{}, error) {
+	address, err := ParseAddress(addressString)
+	if err != nil {
+		return nil, badRequest("invalid address: %v", err)
+	}
+	return h.run(func(server *BlockChainServer) (interface{}, error) {
+		inputs := server.spendableInputs(address)
+		if total {
+			balance := 0
+			for _, amount := range inputs {
+				balance += amount
+			}
+			return balanceJSON{address.String(), balance}, nil
+		}
+
+		outPoints := make([]OutPoint, 0, len(inputs))
+		for outPoint := range inputs {
+			outPoints = append(outPoints, outPoint)
+		}
+		sortOutPoints(outPoints)
+		list := make([]inputJSON, 0, len(outPoints))
+		for _, outPoint := range outPoints {
+			list = append(list, inputJSON{outPoint.Hash.String(), outPoint.Index, inputs[outPoint]})
+		}
+		return list, nil
+	})
+}
+
+type pendingJSON struct {
+	Hash string `json:"hash"`
+	Fee  int    `json:"fee"`
+	Size int    `json:"size"`
+}
+
+func apiMempool(server *BlockChainServer) (interface{}, error) {
+	pending := make([]pendingJSON, 0, server.mempool.Len())
+	for _, p := range server.mempool.Entries() {
+		pending = append(pending, pendingJSON{p.hash.String(), p.fee, p.size})
+	}
+	return pending, nil
+}
+
+type submitJSON struct {
+	Hex string `json:"hex"`
+}
+
+type submittedJSON struct {
+	Hash string `json:"hash"`
+}
+
+// Decodes a signed transaction in its canonical encoding and submits
+// it as if it had been sent with the Transact RPC.
+func (h *apiHandler) submitTransaction(w http.ResponseWriter, body io.ReadCloser) (interface{}, error) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, body, maxAPIRequestSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, &apiError{http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var submit submitJSON
+	err = json.Unmarshal(data, &submit)
+	if err != nil {
+		return nil, badRequest("invalid JSON: %v", err)
+	}
+	encoded, err := hex.DecodeString(submit.Hex)
+	if err != nil {
+		return nil, badRequest("transaction is not valid hex: %v", err)
+	}
+	tx, err := DecodeTransaction(encoded)
+	if err != nil {
+		return nil, badRequest("invalid transaction: %v", err)
+	}
+
+	cb := make(chan error)
+	h.server.requests <- TransactionRequest{*tx, cb}
+	err = <-cb
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		return nil, &apiError{http.StatusConflict, "conflict", err.Error()}
+	}
+	if err != nil {
+		return nil, &apiError{http.StatusUnprocessableEntity, "rejected", err.Error()}
+	}
+	hash := tx.Hash()
+	return submittedJSON{hash.String()}, nil
+}
+
+type outputJSON struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+type txJSON struct {
+	Hash       string       `json:"hash"`
+	Inputs     []inputJSON  `json:"inputs"`
+	Senders    []string     `json:"senders"`
+	Outputs    []outputJSON `json:"outputs"`
+	Signatures []string     `json:"signatures"`
+	Hex        string       `json:"hex"`
+}
+
+func newTxJSON(t *Transaction) txJSON {
+	hash := t.Hash()
+	inputs := make([]inputJSON, 0, len(t.Inputs))
+	for _, input := range t.Inputs {
+		inputs = append(inputs, inputJSON{input.Hash.String(), input.Index, 0})
+	}
+	outputs := make([]outputJSON, 0, len(t.Outputs))
+	for _, output := range t.Outputs {
+		outputs = append(outputs, outputJSON{output.Address.String(), output.Amount})
+	}
+	senders := make([]string, 0, len(t.Senders))
+	for _, sender := range t.Senders {
+		if sender.N != nil {
+			senders = append(senders, publicKeyString(sender))
+		}
+	}
+	signatures := make([]string, 0, len(t.Signatures))
+	for _, signature := range t.Signatures {
+		signatures = append(signatures, hex.EncodeToString(signature))
+	}
+	return txJSON{
+		hash.String(),
+		inputs,
+		senders,
+		outputs,
+		signatures,
+		hex.EncodeToString(t.Encode()),
+	}
+}
+
+type blockJSON struct {
+	Hash         string   `json:"hash"`
+	PrevHash     string   `json:"prev_hash"`
+	MerkleRoot   string   `json:"merkle_root"`
+	Timestamp    int64    `json:"timestamp"`
+	Bits         string   `json:"bits"`
+	Nonce        int      `json:"nonce"`
+	Height       int      `json:"height"`
+	MainChain    bool     `json:"main_chain"`
+	Transactions []txJSON `json:"transactions"`
+}
+
+func newBlockJSON(bc *BlockChain, block *Block) blockJSON {
+	hash := block.Hash()
+	txs := make([]txJSON, 0, len(block.Transactions))
+	for i := range block.Transactions {
+		txs = append(txs, newTxJSON(&block.Transactions[i]))
+	}
+	return blockJSON{
+		hash.String(),
+		block.PrevHash.String(),
+		block.MerkleRoot.String(),
+		block.Timestamp,
+		fmt.Sprintf("%08x", block.Bits),
+		block.Nonce,
+		bc.index[hash].height,
+		bc.onMainChain(hash),
+		txs,
+	}
+}
+
+type peerJSON struct {
+	Address         string `json:"address"`
+	Status          string `json:"status"`
+	LastSeen        string `json:"last_seen"`
+	ProtocolVersion uint32 `json:"protocol_version"`
+	UserAgent       string `json:"user_agent"`
+	BestHeight      int    `json:"best_height"`
+}
+
+func newPeerJSON(info PeerInfo) peerJSON {
+	return peerJSON{
+		info.Address,
+		info.Status,
+		info.LastSeen.Format(time.RFC3339),
+		info.Version.ProtocolVersion,
+		info.Version.UserAgent,
+		info.Version.BestHeight,
+	}
+}
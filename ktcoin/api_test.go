@@ -0,0 +1,164 @@
+package ktcoin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func apiGet(t *testing.T, api http.Handler, path string, status int, value interface{}) {
+	request := httptest.NewRequest("GET", path, nil)
+	response := httptest.NewRecorder()
+	api.ServeHTTP(response, request)
+	if response.Code != status {
+		t.Fatalf("GET %s: got status %d, want %d: %s", path, response.Code, status, response.Body)
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), value); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func TestAPIChain(t *testing.T) {
+	bc := newTestBlockChain()
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	coinbase := testCoinbase(key, bc.latestBlock)
+	if err := bc.addNextBlock(10000, 0, []Transaction{coinbase}); err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPIHandler(newTestServer(t, &bc))
+
+	var tip tipJSON
+	apiGet(t, api, "/api/tip", http.StatusOK, &tip)
+	if tip.Hash != bc.latestBlock.String() || tip.Height != 1 {
+		t.Error("wrong tip:", tip)
+	}
+
+	var block blockJSON
+	apiGet(t, api, "/api/blocks/height/1", http.StatusOK, &block)
+	if block.Hash != tip.Hash || !block.MainChain || len(block.Transactions) != 1 {
+		t.Error("wrong block at height 1:", block)
+	}
+	apiGet(t, api, "/api/blocks/"+block.PrevHash, http.StatusOK, &block)
+	if block.Height != 0 {
+		t.Error("wrong genesis block:", block)
+	}
+
+	var mined minedTransactionJSON
+	coinbaseHash := coinbase.Hash()
+	apiGet(t, api, "/api/transactions/"+coinbaseHash.String(), http.StatusOK, &mined)
+	if mined.Confirmations != 1 || mined.Pending || mined.Block != tip.Hash {
+		t.Error("wrong transaction:", mined)
+	}
+	if mined.Transaction.Hex != hex.EncodeToString(coinbase.Encode()) {
+		t.Error("transaction hex is not its canonical encoding")
+	}
+
+	var balance balanceJSON
+	apiGet(t, api, "/api/addresses/"+AddressFromKey(key.PublicKey).String()+"/balance", http.StatusOK, &balance)
+	if balance.Balance != 25 {
+		t.Error("wrong balance:", balance)
+	}
+	var inputs []inputJSON
+	apiGet(t, api, "/api/addresses/"+AddressFromKey(key.PublicKey).String()+"/inputs", http.StatusOK, &inputs)
+	if len(inputs) != 1 || inputs[0].Hash != coinbaseHash.String() || inputs[0].Amount != 25 {
+		t.Error("wrong inputs:", inputs)
+	}
+
+	var apiErr errorBody
+	apiGet(t, api, "/api/blocks/height/5", http.StatusNotFound, &apiErr)
+	if apiErr.Error.Code != "not_found" {
+		t.Error("wrong error:", apiErr)
+	}
+	apiGet(t, api, "/api/blocks/xyz", http.StatusBadRequest, &apiErr)
+	if apiErr.Error.Code != "bad_request" {
+		t.Error("wrong error:", apiErr)
+	}
+	apiGet(t, api, "/api/addresses/00/balance", http.StatusBadRequest, &apiErr)
+	apiGet(t, api, "/api/nothing", http.StatusNotFound, &apiErr)
+}
+
+func TestAPISubmitTransaction(t *testing.T) {
+	bc := newTestBlockChain()
+	alice, _ := rsa.GenerateKey(rand.Reader, 1024)
+	bob, _ := rsa.GenerateKey(rand.Reader, 1024)
+	coinbase := testCoinbase(alice, bc.latestBlock)
+	if err := bc.addNextBlock(10000, 0, []Transaction{coinbase}); err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPIHandler(newTestServer(t, &bc))
+
+	submit := func(body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/api/transactions", bytes.NewBufferString(body))
+		response := httptest.NewRecorder()
+		api.ServeHTTP(response, request)
+		return response
+	}
+
+	tx, _ := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(bob.PublicKey), 20}}, 2)
+	body, _ := json.Marshal(submitJSON{hex.EncodeToString(tx.Encode())})
+	response := submit(string(body))
+	if response.Code != http.StatusOK {
+		t.Fatal("transaction was rejected:", response.Body)
+	}
+	var submitted submittedJSON
+	json.Unmarshal(response.Body.Bytes(), &submitted)
+	if txHash := tx.Hash(); submitted.Hash != txHash.String() {
+		t.Error("wrong hash for submitted transaction")
+	}
+
+	var pending []pendingJSON
+	apiGet(t, api, "/api/mempool", http.StatusOK, &pending)
+	if len(pending) != 1 || pending[0].Hash != submitted.Hash || pending[0].Fee != 2 {
+		t.Error("wrong mempool:", pending)
+	}
+	var found minedTransactionJSON
+	apiGet(t, api, "/api/transactions/"+submitted.Hash, http.StatusOK, &found)
+	if !found.Pending || found.Confirmations != 0 {
+		t.Error("submitted transaction is not pending:", found)
+	}
+
+	// The output it spends is no longer open to spend.
+	var balance balanceJSON
+	apiGet(t, api, "/api/addresses/"+AddressFromKey(alice.PublicKey).String()+"/balance", http.StatusOK, &balance)
+	if balance.Balance != 0 {
+		t.Error("balance includes a pending spend:", balance)
+	}
+	var inputs []inputJSON
+	apiGet(t, api, "/api/addresses/"+AddressFromKey(alice.PublicKey).String()+"/inputs", http.StatusOK, &inputs)
+	if len(inputs) != 0 {
+		t.Error("inputs include a pending spend:", inputs)
+	}
+
+	// A conflicting spend, undecodable transactions and oversized
+	// bodies are rejected with structured errors.
+	conflicting, _ := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(alice.PublicKey), 25}}, 0)
+	body, _ = json.Marshal(submitJSON{hex.EncodeToString(conflicting.Encode())})
+	tooLarge := `{"hex": "` + strings.Repeat("00", maxAPIRequestSize) + `"}`
+	for input, status := range map[string]int{
+		string(body):      http.StatusConflict,
+		`{"hex": "zz"}`:   http.StatusBadRequest,
+		`{"hex": "0000"}`: http.StatusBadRequest,
+		`not json`:        http.StatusBadRequest,
+		tooLarge:          http.StatusRequestEntityTooLarge,
+	} {
+		response := submit(input)
+		var apiErr errorBody
+		json.Unmarshal(response.Body.Bytes(), &apiErr)
+		if response.Code != status || apiErr.Error.Code == "" {
+			t.Errorf("%.20s: got status %d and %+v, want status %d", input, response.Code, apiErr, status)
+		}
+	}
+}
@@ -1,197 +1,635 @@
 package ktcoin
 
 import (
-	"crypto"
-	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/big"
+	"time"
 )
 
-// A Block consists of the previous block's hash, the list of
-// transactions it enacts, and a nonce.  For a block to be valid, the
-// SHA256 hash must have sufficient leading zeroes to satisfy the
-// proof of work property.
+// A block header commits to the previous block's hash, the merkle
+// root of the block's transactions, the time it was mined, the target
+// its hash must meet (in compact form) and a nonce.  For a block to be
+// valid, the SHA256 hash of its header, read as a 256-bit number, must
+// be no greater than the target to satisfy the proof of work property.
+type BlockHeader struct {
+	PrevHash   SHA
+	MerkleRoot SHA
+	Timestamp  int64
+	Bits       uint32
+	Nonce      int
+}
+
+// A Block is a header followed by the list of transactions it enacts.
 type Block struct {
-	PrevHash     SHA
-	Nonce        int
+	BlockHeader
 	Transactions []Transaction
 }
 
+// Builds a block whose header commits to the given transactions.
+func NewBlock(prevHash SHA, timestamp int64, bits uint32, nonce int, transactions []Transaction) Block {
+	header := BlockHeader{prevHash, merkleRoot(transactions), timestamp, bits, nonce}
+	return Block{header, transactions}
+}
+
 func (block *Block) String() string {
 	transactions := ""
 	for _, t := range block.Transactions {
 		transactions += t.String()
 	}
-	return fmt.Sprintf("{prevHash: %x,\n transactions: [%s]}", block.PrevHash, transactions)
+	return fmt.Sprintf("{prevHash: %x,\n merkleRoot: %x,\n timestamp: %d,\n bits: %08x,\n transactions: [%s]}", block.PrevHash, block.MerkleRoot, block.Timestamp, block.Bits, transactions)
 }
 
+// The block chain keeps every valid block it has seen, including
+// blocks on side branches, along with metadata about where each one
+// sits in the tree of blocks.  latestBlock is always the tip of the
+// chain with the most cumulative work, mainChain lists the blocks of
+// that chain by height, and utxos reflects the state after applying
+// every block on it.  txIndex maps the hash of each transaction on the
+// main chain to the block containing it.
 type BlockChain struct {
-	latestBlock      SHA
-	blocks           map[SHA]Block
-	openTransactions map[SHA]map[string]int
+	latestBlock SHA
+	blocks      map[SHA]Block
+	index       map[SHA]*blockMeta
+	mainChain   []SHA
+	txIndex     map[SHA]SHA
+	utxos       UTXOSet
+	undo        map[SHA][]spentOutput
+	store       *BlockStore
+	params      ChainParams
+	listener    ChainListener
+}
+
+// A ChainListener is told whenever a block joins or leaves the main
+// chain, including each step of a reorganization.
+type ChainListener interface {
+	BlockConnected(block *Block)
+	BlockDisconnected(block *Block)
+}
+
+// What the chain knows about a block besides its contents: its
+// height above the genesis block, the cumulative proof of work needed
+// to produce it and its ancestors, and its parent.
+type blockMeta struct {
+	height int
+	work   *big.Int
+	parent SHA
+}
+
+// A record of an output spent when a block was connected, so that the
+// block can be disconnected again during a reorganization.
+type spentOutput struct {
+	outPoint OutPoint
+	out      TxOut
 }
 
+// The number of new coins the miner of each block may claim, on top
+// of the fees paid by the block's transactions.
+const BlockReward = 25
+
+// The most coins a single output may hold, and the most that the
+// inputs or outputs of one transaction, or the fees of one block, may
+// add up to.  Keeping every amount and total under it means adding
+// them up can never overflow.
+const MaxMoney = 21000000
+
+// Adds amount to a running total of coins, failing if the amount or
+// the new total is more than MaxMoney.  Amounts are checked for being
+// negative separately.
+func addAmount(total int, amount int) (int, error) {
+	if amount > MaxMoney {
+		return 0, fmt.Errorf("amount %d is more than %d", amount, MaxMoney)
+	}
+	total += amount
+	if total > MaxMoney {
+		return 0, fmt.Errorf("total of %d coins is more than %d", total, MaxMoney)
+	}
+	return total, nil
+}
+
+var errUnknownParent = errors.New("block's previous block is unknown")
+
+// Returned when a transaction spends an output that another
+// transaction in the same block, or already waiting to be mined,
+// also spends.
+type ConflictError struct {
+	Tx            SHA
+	ConflictsWith SHA
+	OutPoint      OutPoint
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("transaction %x conflicts with transaction %x: both spend %v", e.Tx, e.ConflictsWith, e.OutPoint)
+}
+
+// Returned by ValidateBlock when the block is invalid because of one
+// of its transactions, other than the coinbase.  Index is the
+// transaction's position in the block.
+type BlockTransactionError struct {
+	Index int
+	Err   error
+}
+
+func (e *BlockTransactionError) Error() string {
+	return fmt.Sprintf("transaction %d: %v", e.Index, e.Err)
+}
+
+func (e *BlockTransactionError) Unwrap() error {
+	return e.Err
+}
+
+// Describes the main chain from the genesis block up, followed by the
+// number of blocks on side branches.
 func (bc *BlockChain) String() string {
 	blocks := ""
-	for _, block := range bc.blocks {
+	for _, sha := range bc.mainChain {
+		block := bc.blocks[sha]
 		blocks += block.String()
 	}
-	return fmt.Sprintf("{blocks: [%s],\nopenTransactions: %d}", blocks, len(bc.openTransactions))
+	sideBlocks := len(bc.blocks) - len(bc.mainChain)
+	return fmt.Sprintf("{blocks: [%s],\nside branch blocks: %d,\nutxos: %d}", blocks, sideBlocks, len(bc.utxos))
 }
 
 func NewBlockChain() BlockChain {
+	return NewBlockChainWithParams(DefaultChainParams)
+}
+
+func NewBlockChainWithParams(params ChainParams) BlockChain {
 	genesisHash := sha256.Sum256([]byte("genesis"))
 	blocks := make(map[SHA]Block)
-	firstBlock := Block{genesisHash, 0, make([]Transaction, 0)}
+	firstBlock := NewBlock(genesisHash, GenesisTimestamp, params.InitialBits, 0, make([]Transaction, 0))
 	firstSha := firstBlock.Hash()
 	blocks[firstSha] = firstBlock
-	openTransactions := make(map[SHA]map[string]int)
+	index := make(map[SHA]*blockMeta)
+	index[firstSha] = &blockMeta{0, big.NewInt(0), SHA{}}
 	return BlockChain{
 		firstSha,
 		blocks,
-		openTransactions,
+		index,
+		[]SHA{firstSha},
+		make(map[SHA]SHA),
+		NewUTXOSet(),
+		make(map[SHA][]spentOutput),
+		nil,
+		params,
+		nil,
 	}
 }
 
+// Opens the block chain stored in dir, replaying every stored block
+// to rebuild the chain tip and the set of unspent outputs.  Blocks
+// accepted afterwards are written to the store.
+func OpenBlockChain(dir string, params ChainParams) (*BlockChain, error) {
+	store, blocks, err := OpenBlockStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	bc := NewBlockChainWithParams(params)
+	for _, block := range blocks {
+		err = bc.addBlock(block)
+		if err != nil {
+			fmt.Println("Skipping stored block:", err)
+		}
+	}
+	bc.store = store
+	return &bc, nil
+}
+
+// A block is identified by the hash of its header alone; the header's
+// merkle root commits to the transactions.
 func (block *Block) Hash() SHA {
-	contents := make([]byte, 0)
-	contents = append(contents, block.PrevHash[:]...)
-	nonceBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(nonceBytes, uint64(block.Nonce))
-	contents = append(contents, nonceBytes...)
+	return block.BlockHeader.Hash()
+}
 
-	for _, t := range block.Transactions {
-		hashedTransaction := t.Hash()
-		contents = append(contents, hashedTransaction[:]...)
+func (header *BlockHeader) Hash() SHA {
+	return sha256.Sum256(header.encode())
+}
+
+func (bc *BlockChain) GetOpenInputs(address Address) map[OutPoint]int {
+	return bc.utxos.ForAddress(address)
+}
+
+// Returns the hash and height of the tip of the main chain.
+func (bc *BlockChain) Tip() (SHA, int) {
+	return bc.latestBlock, len(bc.mainChain) - 1
+}
+
+// Returns the block at the given height on the main chain, where the
+// genesis block is at height 0.
+func (bc *BlockChain) BlockAt(height int) (*Block, error) {
+	if height < 0 || height >= len(bc.mainChain) {
+		return nil, fmt.Errorf("no block at height %d", height)
 	}
+	block := bc.blocks[bc.mainChain[height]]
+	return &block, nil
+}
 
-	hash := sha256.Sum256(contents)
-	return hash
+// Returns the hashes of a block's ancestors, from its parent back to
+// the genesis block.  The block may be on a side branch.
+func (bc *BlockChain) Ancestors(sha SHA) ([]SHA, error) {
+	meta, ok := bc.index[sha]
+	if !ok {
+		return nil, errors.New("unknown block")
+	}
+	ancestors := make([]SHA, 0, meta.height)
+	for meta.height > 0 {
+		ancestors = append(ancestors, meta.parent)
+		meta = bc.index[meta.parent]
+	}
+	return ancestors, nil
 }
 
-func (bc *BlockChain) GetOpenInputs(key rsa.PublicKey) map[SHA]int {
-	openInputs := make(map[SHA]int)
+// Returns the number of blocks on the main chain that confirm a
+// transaction: 1 if it's in the tip, 2 if it's in the block before,
+// and so on.  Transactions that aren't on the main chain have no
+// confirmations.
+func (bc *BlockChain) Confirmations(txHash SHA) int {
+	sha, ok := bc.txIndex[txHash]
+	if !ok {
+		return 0
+	}
+	return len(bc.mainChain) - bc.index[sha].height
+}
+
+func (block *Block) isValid() bool {
+	return hashMeetsTarget(block.Hash(), CompactToBig(block.Bits))
+}
+
+// Builds the next block on the current tip, timestamped now (or just
+// after the median time of recent blocks, if our clock is behind) and
+// using the target the chain requires.
+func (bc *BlockChain) newBlockTemplate(nonce int, transactions []Transaction) Block {
+	prevHash := bc.latestBlock
+	timestamp := time.Now().Unix()
+	if earliest := bc.medianTimePast(prevHash) + 1; timestamp < earliest {
+		timestamp = earliest
+	}
+	return NewBlock(prevHash, timestamp, bc.nextBits(prevHash), nonce, transactions)
+}
+
+func (bc *BlockChain) addNextBlock(limit int, nonce int, transactions []Transaction) error {
+	// Check the block before spending any effort mining it
+	newBlock := bc.newBlockTemplate(nonce, transactions)
+	err := bc.ValidateBlock(&newBlock)
+	if err != nil {
+		fmt.Println("verification error")
+		return err
+	}
 
-	for sha, outputs := range bc.openTransactions {
-		amount, isPresent := outputs[publicKeyString(key)]
-		if isPresent {
-			openInputs[sha] = amount
+	// Look for the magic hash value
+	for i := 0; !newBlock.isValid(); i++ {
+		if i >= limit {
+			return errors.New("limit reached")
 		}
+		newBlock.Nonce++
 	}
 
-	return openInputs
+	return bc.addBlock(newBlock)
 }
 
-func (block *Block) isValid(difficulty int) bool {
-	hashedBlock := block.Hash()
-	for i := 0; i < difficulty; i++ {
-		if hashedBlock[i] != 0 {
-			return false
+// Adds a block to the chain.  The block is kept even if it doesn't
+// extend the current tip; if its branch ends up with more cumulative
+// work than the current chain, the chain is reorganized onto it.
+func (bc *BlockChain) addBlock(block Block) error {
+	blockSha := block.Hash()
+	if _, ok := bc.blocks[blockSha]; ok {
+		return nil
+	}
+
+	parent, ok := bc.index[block.PrevHash]
+	if !ok {
+		return errUnknownParent
+	}
+
+	err := bc.checkHeader(&block)
+	if err != nil {
+		return err
+	}
+	// A block whose transactions repeat a hash in the merkle tree
+	// shares its hash with a block that doesn't, so it's rejected
+	// before it's kept under that hash.
+	root, mutated := merkleRootMutated(block.Transactions)
+	if block.MerkleRoot != root {
+		return errors.New("block's merkle root does not match its transactions")
+	}
+	if mutated {
+		return errors.New("block's transactions repeat a hash in the merkle tree")
+	}
+
+	// The block is stored before the chain changes, so that a block
+	// that becomes part of the chain is never missing from the disk.
+	// A block that turns out to be invalid when it's connected is
+	// skipped when the chain is rebuilt.
+	if bc.store != nil {
+		err = bc.store.Put(block)
+		if err != nil {
+			return err
 		}
 	}
-	return true
+
+	bc.blocks[blockSha] = block
+	bc.index[blockSha] = &blockMeta{
+		parent.height + 1,
+		new(big.Int).Add(parent.work, blockWork(block.Bits)),
+		block.PrevHash,
+	}
+
+	if block.PrevHash == bc.latestBlock {
+		err := bc.connectBlock(blockSha)
+		if err != nil {
+			bc.removeBlock(blockSha)
+			return err
+		}
+	} else if bc.index[blockSha].work.Cmp(bc.index[bc.latestBlock].work) > 0 {
+		err := bc.reorganize(blockSha)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (bc *BlockChain) addNextBlock(difficulty int, limit int, nonce int, transactions []Transaction) error {
-	// Verify transactions
-	for i, t := range transactions {
-		if i == 0 {
-			// Special case: money from nothing
-			outputTotal := 0
-			for _, v := range t.Outputs {
-				outputTotal += v
-			}
-			if outputTotal != 25 {
-				return errors.New("Invalid genesis transaction: does not create 25 coins")
-			}
-		} else {
-			err := bc.Verify(&t)
-			if err != nil {
-				fmt.Println("verification error")
-				return err
+// Forgets a block that turned out to be invalid, along with every
+// block built on it, none of which can be valid either.
+func (bc *BlockChain) removeBlock(sha SHA) {
+	delete(bc.blocks, sha)
+	delete(bc.index, sha)
+	for child, meta := range bc.index {
+		if meta.parent == sha {
+			bc.removeBlock(child)
+		}
+	}
+}
+
+// Validates the block and applies its transactions, making it the new
+// tip.  The block must extend the current tip.
+func (bc *BlockChain) connectBlock(sha SHA) error {
+	block := bc.blocks[sha]
+	err := bc.ValidateBlock(&block)
+	if err != nil {
+		return err
+	}
+
+	spent := make([]spentOutput, 0)
+	for i, transaction := range block.Transactions {
+		// The coinbase's input is a placeholder, not a real output.
+		if i > 0 {
+			for _, input := range transaction.Inputs {
+				out, err := bc.utxos.Spend(input)
+				if err != nil {
+					// Another transaction in this block
+					// already spent the input.
+					bc.revertTransactions(block.Transactions[:i+1], spent)
+					return err
+				}
+				spent = append(spent, spentOutput{input, out})
 			}
 		}
+		bc.utxos.AddTransaction(&transaction)
+	}
+	for _, transaction := range block.Transactions {
+		bc.txIndex[transaction.Hash()] = sha
+	}
+	bc.undo[sha] = spent
+	bc.mainChain = append(bc.mainChain, sha)
+	bc.latestBlock = sha
+	if bc.listener != nil {
+		bc.listener.BlockConnected(&block)
 	}
+	return nil
+}
 
-	// Look for the magic hash value
-	prevHash := bc.latestBlock
+// Undoes the effects of the tip block on the UTXO set, making its
+// parent the new tip.
+func (bc *BlockChain) disconnectBlock() {
+	sha := bc.latestBlock
+	block := bc.blocks[sha]
+	bc.revertTransactions(block.Transactions, bc.undo[sha])
+	for _, transaction := range block.Transactions {
+		delete(bc.txIndex, transaction.Hash())
+	}
+	delete(bc.undo, sha)
+	bc.mainChain = bc.mainChain[:len(bc.mainChain)-1]
+	bc.latestBlock = block.PrevHash
+	if bc.listener != nil {
+		bc.listener.BlockDisconnected(&block)
+	}
+}
+
+// Checks that a block's transactions are valid as the next block on
+// the current chain.  Every block goes through here before it's
+// connected, whether it was mined locally or received from a peer:
+//
+//  1. The first transaction must be the block's only coinbase, with a
+//     single input pointing at the previous block and no senders or
+//     signatures.
+//  2. Every other transaction must spend at least one real input and
+//     verify against the current UTXO set, and no two transactions
+//     may spend the same input.
+//  3. The coinbase may not create more than the block reward plus the
+//     fees paid by the other transactions.
+//
+// Proof of work is checked separately, when the block is added.
+func (bc *BlockChain) ValidateBlock(block *Block) error {
+	if block.PrevHash != bc.latestBlock {
+		return errors.New("block does not extend the current tip")
+	}
+	if len(block.Transactions) == 0 {
+		return errors.New("block has no coinbase transaction")
+	}
 
-	newBlock := Block{prevHash, nonce, transactions}
+	coinbase := block.Transactions[0]
+	if len(coinbase.Inputs) != 1 || coinbase.Inputs[0] != coinbaseInput(block.PrevHash) {
+		return errors.New("first transaction is not a coinbase for this block")
+	}
+	if len(coinbase.Senders) != 0 || len(coinbase.Signatures) != 0 {
+		return errors.New("coinbase transaction has senders or signatures")
+	}
 
-	for i := 0; !newBlock.isValid(difficulty); i++ {
-		if i >= limit {
-			return errors.New("limit reached")
+	fees := 0
+	spentBy := make(map[OutPoint]SHA)
+	for i := 1; i < len(block.Transactions); i++ {
+		t := &block.Transactions[i]
+		if len(t.Inputs) == 0 {
+			return &BlockTransactionError{i, errors.New("no inputs")}
+		}
+		for _, input := range t.Inputs {
+			if input.Index == CoinbaseIndex {
+				return &BlockTransactionError{i, errors.New("extra coinbase")}
+			}
+		}
+		fee, err := bc.verifyTransaction(t)
+		if err != nil {
+			return &BlockTransactionError{i, err}
+		}
+
+		// Each transaction verifies against the state before the
+		// block, so check that none of them spend the same input.
+		hash := t.Hash()
+		for _, input := range t.Inputs {
+			if other, ok := spentBy[input]; ok {
+				return &BlockTransactionError{i, &ConflictError{hash, other, input}}
+			}
+			spentBy[input] = hash
+		}
+		fees, err = addAmount(fees, fee)
+		if err != nil {
+			return &BlockTransactionError{i, fmt.Errorf("block fees: %v", err)}
 		}
-		newBlock.Nonce++
 	}
 
-	// Append the block to the chain
-	newBlockSha := newBlock.Hash()
-	bc.blocks[newBlockSha] = newBlock
-	bc.latestBlock = newBlockSha
+	// Special case: money from nothing.  The miner may claim the
+	// block reward plus the fees paid by every other transaction.
+	outputTotal := 0
+	for _, out := range coinbase.Outputs {
+		if out.Amount < 0 {
+			return errors.New("Cannot have negative output amount")
+		}
+		var err error
+		outputTotal, err = addAmount(outputTotal, out.Amount)
+		if err != nil {
+			return fmt.Errorf("Invalid coinbase transaction: %v", err)
+		}
+	}
+	if outputTotal > BlockReward+fees {
+		return fmt.Errorf("Invalid coinbase transaction: creates %d coins, more than %d", outputTotal, BlockReward+fees)
+	}
+	return nil
+}
 
+// Removes the outputs created by transactions from the UTXO set and
+// restores the outputs they spent.
+func (bc *BlockChain) revertTransactions(transactions []Transaction, spent []spentOutput) {
 	for _, transaction := range transactions {
-		for _, input := range transaction.Inputs {
-			delete(bc.openTransactions[input], publicKeyString(transaction.Sender))
+		hash := transaction.Hash()
+		for i := range transaction.Outputs {
+			delete(bc.utxos, OutPoint{hash, uint32(i)})
+		}
+	}
+	for _, s := range spent {
+		bc.utxos.Add(s.outPoint, s.out)
+	}
+}
+
+// Returns true if the block is part of the chain ending at the
+// current tip.
+func (bc *BlockChain) onMainChain(sha SHA) bool {
+	meta, ok := bc.index[sha]
+	return ok && meta.height < len(bc.mainChain) && bc.mainChain[meta.height] == sha
+}
+
+// Switches the chain over to the branch ending at newTip by
+// disconnecting blocks back to the fork point and connecting the
+// blocks of the new branch.  If a block on the new branch turns out
+// to be invalid, it and its descendants are discarded and the old
+// chain is restored.
+func (bc *BlockChain) reorganize(newTip SHA) error {
+	branch := make([]SHA, 0)
+	fork := newTip
+	for !bc.onMainChain(fork) {
+		branch = append(branch, fork)
+		fork = bc.blocks[fork].PrevHash
+	}
+
+	disconnected := make([]SHA, 0)
+	for bc.latestBlock != fork {
+		disconnected = append(disconnected, bc.latestBlock)
+		bc.disconnectBlock()
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		err := bc.connectBlock(branch[i])
+		if err != nil {
+			bc.removeBlock(branch[i])
+			for bc.latestBlock != fork {
+				bc.disconnectBlock()
+			}
+			for k := len(disconnected) - 1; k >= 0; k-- {
+				// These blocks were connected a moment ago, so
+				// this only fails if the chain state is corrupt.
+				restoreErr := bc.connectBlock(disconnected[k])
+				if restoreErr != nil {
+					return fmt.Errorf("%v; restoring the old chain failed: %v", err, restoreErr)
+				}
+			}
+			return err
 		}
-		hashedTransaction := transaction.Hash()
-		bc.openTransactions[hashedTransaction] = transaction.Outputs
 	}
 	return nil
 }
 
 // How to verify a transaction on the block chain:
-// - Check that the
-//   transaction is internally consistent (inputs equal outputs,
-//   signature is valid)
-// - Check that each of the transaction's inputs
-//   is open for spending (i.e. hasn't been used yet as an input to
-//   another transaction)
-
-// How to store information on the block chain? Keep a set of transactions open for spending?
+//   - Check that the
+//     transaction is internally consistent (outputs don't exceed
+//     inputs, signature is valid)
+//   - Check that each of the transaction's inputs is in the UTXO set
+//     (i.e. hasn't been used yet as an input to another transaction)
+//     and belongs to the sender
 func (bc *BlockChain) Verify(t *Transaction) error {
-	// Verify signature
-	hashed, err := bytesToSign(t.Recipient, t.Inputs)
-	if err != nil {
-		return err
-	}
-	err = rsa.VerifyPKCS1v15(&t.Sender, crypto.SHA256, hashed[:], t.Signature)
+	_, err := bc.verifyTransaction(t)
+	return err
+}
+
+// Verifies a transaction and returns the fee it pays: the amount by
+// which its inputs exceed its outputs, which goes to the miner of the
+// block that includes it.
+func (bc *BlockChain) verifyTransaction(t *Transaction) (int, error) {
+	// Verify signatures
+	err := t.VerifySignatures()
 	if err != nil {
-		return errors.New("invalid signature")
+		return 0, err
 	}
 
-	// Verify tx inputs are keys in t.openTransactions
+	// Verify tx inputs are open and each paid to the address of one of
+	// the senders, and that every sender owns at least one of them
+	senders := make(map[Address]bool)
+	for _, sender := range t.Senders {
+		senders[AddressFromKey(sender)] = false
+	}
+	inputTotal := 0
+	seen := make(map[OutPoint]bool)
 	for _, input := range t.Inputs {
-		if val, ok := bc.openTransactions[input]; ok {
-			if _, ok = val[publicKeyString(t.Sender)]; !ok {
-				return errors.New("Sender does not own this transaction")
-			}
-		} else {
-			return errors.New("Transaction not open")
+		if seen[input] {
+			return 0, fmt.Errorf("input %v is spent twice", input)
 		}
-	}
+		seen[input] = true
 
-	// Verify tx amounts are valid (inputs equal outputs)
-	inputTotal := 0
-	for _, inputSha := range t.Inputs {
-		outputAmounts, _ := bc.openTransactions[inputSha]
-		senderAmount, _ := outputAmounts[publicKeyString(t.Sender)]
-		inputTotal += senderAmount
+		out, ok := bc.utxos.Lookup(input)
+		if !ok {
+			return 0, fmt.Errorf("input %v is not open", input)
+		}
+		if _, ok := senders[out.Address]; !ok {
+			return 0, errors.New("Sender does not own this transaction")
+		}
+		senders[out.Address] = true
+		inputTotal, err = addAmount(inputTotal, out.Amount)
+		if err != nil {
+			return 0, fmt.Errorf("tx inputs: %v", err)
+		}
+	}
+	for _, owns := range senders {
+		if !owns {
+			return 0, errors.New("sender does not own any of the inputs")
+		}
 	}
 
+	// Verify tx amounts are valid (outputs don't exceed inputs)
 	outputTotal := 0
-	for _, amount := range t.Outputs {
-		if amount < 0 {
-			return errors.New("Cannot have negative output amount")
+	for _, out := range t.Outputs {
+		if out.Amount < 0 {
+			return 0, errors.New("Cannot have negative output amount")
+		}
+		outputTotal, err = addAmount(outputTotal, out.Amount)
+		if err != nil {
+			return 0, fmt.Errorf("tx outputs: %v", err)
 		}
-		outputTotal += amount
 	}
 
-	if inputTotal != outputTotal {
-		return fmt.Errorf("tx inputs (%d) do not match outputs (%d)", inputTotal, outputTotal)
+	if outputTotal > inputTotal {
+		return 0, fmt.Errorf("tx outputs (%d) exceed inputs (%d)", outputTotal, inputTotal)
 	}
 
-	return nil
+	return inputTotal - outputTotal, nil
 }
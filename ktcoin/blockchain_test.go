@@ -1,30 +1,28 @@
 package ktcoin
 
 import (
-	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
+	"math"
 	"testing"
+	"time"
 )
 
 func TestVerifyTransaction(t *testing.T) {
-	bc := NewBlockChain()
+	bc := newTestBlockChain()
 	sender, _ := rsa.GenerateKey(rand.Reader, 2048)
 	recipient, _ := rsa.GenerateKey(rand.Reader, 2048)
 
-	// Build a dummy transaction to serve as input
-	dummyOutputs := make(map[string]int)
-	// Give sender 2 coins to send
-	dummyOutputs[publicKeyString(sender.PublicKey)] = 25
-	bytes, _ := bytesToSign(sender.PublicKey, []SHA{})
-	dummySignature, _ := rsa.SignPKCS1v15(rand.Reader, sender, crypto.SHA256, bytes[:])
-	inputTransaction := Transaction{[]SHA{}, sender.PublicKey, sender.PublicKey, dummyOutputs, dummySignature}
+	// Build a coinbase transaction to serve as input, giving the
+	// sender 25 coins to send
+	inputTransaction := testCoinbase(sender, bc.latestBlock)
 
 	inputs := []Transaction{
 		inputTransaction,
 	}
 
-	tx, err := NewTransaction(inputs, sender, recipient.PublicKey, 1)
+	tx, err := NewTransaction(outputsOf(&inputTransaction), sender, []Payment{{AddressFromKey(recipient.PublicKey), 1}}, 0)
 	if err != nil {
 		t.Error(err)
 	}
@@ -36,7 +34,7 @@ func TestVerifyTransaction(t *testing.T) {
 		t.Fail()
 	}
 
-	err = bc.addNextBlock(1, 10000, 0, inputs)
+	err = bc.addNextBlock(10000, 0, inputs)
 	if err != nil {
 		t.Error(err)
 	}
@@ -49,26 +47,22 @@ func TestVerifyTransaction(t *testing.T) {
 }
 
 func TestAddBlock(t *testing.T) {
-	bc := NewBlockChain()
+	bc := newTestBlockChain()
 	key, _ := rsa.GenerateKey(rand.Reader, 2048)
 	transactions := make([]Transaction, 0)
 
 	recipient := key.PublicKey
-	inputs := make([]SHA, 0)
+	inputs := []OutPoint{coinbaseInput(bc.latestBlock)}
 
-	toSign, _ := bytesToSign(recipient, inputs)
-	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, toSign[:])
-	outputs := make(map[string]int, 0)
-	outputs[publicKeyString(recipient)] = 25
+	outputs := []TxOut{{AddressFromKey(recipient), 25}}
 	tx := Transaction{
 		inputs,
-		key.PublicKey,
-		recipient,
+		nil,
 		outputs,
-		signature,
+		nil,
 	}
 	transactions = append(transactions, tx)
-	err := bc.addNextBlock(1, 10000, 0, transactions)
+	err := bc.addNextBlock(10000, 0, transactions)
 	if err != nil {
 		t.Error(err)
 	}
@@ -76,3 +70,493 @@ func TestAddBlock(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func testCoinbase(key *rsa.PrivateKey, prevHash SHA) Transaction {
+	return *NewCoinbase(AddressFromKey(key.PublicKey), prevHash, 25)
+}
+
+// Returns every output of a transaction as inputs for a new one.
+func outputsOf(t *Transaction) map[OutPoint]int {
+	inputs := make(map[OutPoint]int)
+	hash := t.Hash()
+	for i, out := range t.Outputs {
+		inputs[OutPoint{hash, uint32(i)}] = out.Amount
+	}
+	return inputs
+}
+
+// Chain parameters that make test blocks quick to mine and never
+// retarget within a test.
+var testChainParams = ChainParams{
+	PowLimitBits:     0x2000ffff,
+	InitialBits:      0x2000ffff,
+	RetargetInterval: 1000,
+	TargetSpacing:    30 * time.Second,
+	MaxAdjustment:    4,
+}
+
+func newTestBlockChain() BlockChain {
+	return NewBlockChainWithParams(testChainParams)
+}
+
+// Mines a block on prevHash with the target bc requires, timestamped
+// one second after its parent.  If bc doesn't know the parent, the
+// block is mined at the initial test target instead.
+func mineTestBlock(bc *BlockChain, prevHash SHA, transactions []Transaction) Block {
+	timestamp := time.Now().Unix()
+	bits := testChainParams.InitialBits
+	if parent, ok := bc.blocks[prevHash]; ok {
+		timestamp = parent.Timestamp + 1
+		bits = bc.nextBits(prevHash)
+	}
+	block := NewBlock(prevHash, timestamp, bits, 0, transactions)
+	for !block.isValid() {
+		block.Nonce++
+	}
+	return block
+}
+
+func balance(inputs map[OutPoint]int) int {
+	total := 0
+	for _, amount := range inputs {
+		total += amount
+	}
+	return total
+}
+
+func TestReorganize(t *testing.T) {
+	bc := newTestBlockChain()
+	genesis := bc.latestBlock
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	// Alice mines a block and spends her coinbase in the next one.
+	a1 := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(alice, genesis)})
+	if err := bc.addBlock(a1); err != nil {
+		t.Fatal(err)
+	}
+	a1Sha := a1.Hash()
+	coinbase := a1.Transactions[0]
+	spend, err := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(bob.PublicKey), 25}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2 := mineTestBlock(&bc, a1Sha, []Transaction{testCoinbase(alice, a1Sha), *spend})
+	if err := bc.addBlock(a2); err != nil {
+		t.Fatal(err)
+	}
+	a2Sha := a2.Hash()
+
+	// Bob mines a competing branch from genesis.  It doesn't become
+	// the main chain until it has more work.
+	b1 := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(bob, genesis)})
+	b1Sha := b1.Hash()
+	b2 := mineTestBlock(&bc, b1Sha, []Transaction{testCoinbase(bob, b1Sha)})
+	b2Sha := b2.Hash()
+	b3 := mineTestBlock(&bc, b2Sha, []Transaction{testCoinbase(bob, b2Sha)})
+	for _, block := range []Block{b1, b2} {
+		if err := bc.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bc.latestBlock != a2Sha {
+		t.Fatal("switched to a branch without more work")
+	}
+
+	if err := bc.addBlock(b3); err != nil {
+		t.Fatal(err)
+	}
+	if bc.latestBlock != b3.Hash() {
+		t.Fatal("did not switch to the heaviest branch")
+	}
+	if len(bc.GetOpenInputs(AddressFromKey(alice.PublicKey))) != 0 {
+		t.Error("alice's coins should have been rolled back")
+	}
+	if len(bc.GetOpenInputs(AddressFromKey(bob.PublicKey))) != 3 {
+		t.Error("bob should own the three coinbases on his branch")
+	}
+
+	// Alice's branch catches up and overtakes Bob's again.
+	a3 := mineTestBlock(&bc, a2Sha, []Transaction{testCoinbase(alice, a2Sha)})
+	a3Sha := a3.Hash()
+	a4 := mineTestBlock(&bc, a3Sha, []Transaction{testCoinbase(alice, a3Sha)})
+	for _, block := range []Block{a3, a4} {
+		if err := bc.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bc.latestBlock != a4.Hash() {
+		t.Fatal("did not switch back to the heaviest branch")
+	}
+	aliceInputs := bc.GetOpenInputs(AddressFromKey(alice.PublicKey))
+	if _, ok := aliceInputs[OutPoint{coinbase.Hash(), 0}]; ok {
+		t.Error("spent coinbase was restored as open")
+	}
+	if balance(aliceInputs) != 75 || len(aliceInputs) != 3 {
+		t.Error("alice's balance is wrong after reorganization:", aliceInputs)
+	}
+	bobInputs := bc.GetOpenInputs(AddressFromKey(bob.PublicKey))
+	if len(bobInputs) != 1 || balance(bobInputs) != 25 {
+		t.Error("bob's balance is wrong after reorganization:", bobInputs)
+	}
+}
+
+func TestReorganizeRejectsInvalidBranch(t *testing.T) {
+	bc := newTestBlockChain()
+	genesis := bc.latestBlock
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	a1 := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(alice, genesis)})
+	if err := bc.addBlock(a1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob's branch spends Alice's coinbase, which doesn't exist on
+	// his branch.
+	spend, _ := NewTransaction(outputsOf(&a1.Transactions[0]), alice, []Payment{{AddressFromKey(bob.PublicKey), 25}}, 0)
+	b1 := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(bob, genesis)})
+	b1Sha := b1.Hash()
+	b2 := mineTestBlock(&bc, b1Sha, []Transaction{testCoinbase(bob, b1Sha), *spend})
+	if err := bc.addBlock(b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.addBlock(b2); err == nil {
+		t.Fatal("accepted a branch with an invalid transaction")
+	}
+	if bc.latestBlock != a1.Hash() {
+		t.Error("did not restore the original chain")
+	}
+	if len(bc.GetOpenInputs(AddressFromKey(alice.PublicKey))) != 1 {
+		t.Error("original chain state was not restored")
+	}
+	if _, ok := bc.blocks[b2.Hash()]; ok {
+		t.Error("invalid block was kept")
+	}
+}
+
+func TestReorganizeDiscardsDescendantsOfInvalidBlock(t *testing.T) {
+	bc := newTestBlockChain()
+	genesis := bc.latestBlock
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+	carol, _ := rsa.GenerateKey(rand.Reader, 2048)
+	extendTestChain(t, &bc, alice, 2)
+	a1 := bc.blocks[bc.mainChain[1]]
+
+	// x spends Alice's coinbase, which doesn't exist on its branch,
+	// and two blocks are built on it.
+	spend, _ := NewTransaction(outputsOf(&a1.Transactions[0]), alice, []Payment{{AddressFromKey(bob.PublicKey), 25}}, 0)
+	x := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(bob, genesis), *spend})
+	xSha := x.Hash()
+	if err := bc.addBlock(x); err != nil {
+		t.Fatal(err)
+	}
+	y1 := mineTestBlock(&bc, xSha, []Transaction{testCoinbase(bob, xSha)})
+	y2 := mineTestBlock(&bc, xSha, []Transaction{testCoinbase(carol, xSha)})
+	for _, block := range []Block{y1, y2} {
+		if err := bc.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	y1Sha, y2Sha := y1.Hash(), y2.Hash()
+	z := mineTestBlock(&bc, y1Sha, []Transaction{testCoinbase(bob, y1Sha)})
+	w := mineTestBlock(&bc, y2Sha, []Transaction{testCoinbase(carol, y2Sha)})
+
+	// z makes x's branch the heaviest, and connecting x fails.
+	if err := bc.addBlock(z); err == nil {
+		t.Fatal("accepted a branch with an invalid block")
+	}
+	for _, sha := range []SHA{xSha, y1Sha, y2Sha} {
+		if _, ok := bc.index[sha]; ok {
+			t.Errorf("kept block %x built on an invalid block", sha)
+		}
+	}
+	// A block on y2 is now an orphan rather than a block whose
+	// ancestors are missing.
+	if err := bc.addBlock(w); err != errUnknownParent {
+		t.Error("expected an unknown parent, got", err)
+	}
+	if bc.latestBlock != bc.mainChain[2] || len(bc.mainChain) != 3 {
+		t.Error("did not restore the original chain")
+	}
+}
+
+func TestSeveralOutputsToOneKey(t *testing.T) {
+	bc := newTestBlockChain()
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	coinbase := testCoinbase(alice, bc.latestBlock)
+	err := bc.addNextBlock(10000, 0, []Transaction{coinbase})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pay Bob twice in one transaction; each payment is a separate
+	// output he can spend on its own.
+	aliceAddress := AddressFromKey(alice.PublicKey)
+	bobAddress := AddressFromKey(bob.PublicKey)
+	payBob := Transaction{
+		[]OutPoint{{coinbase.Hash(), 0}},
+		nil,
+		[]TxOut{{bobAddress, 10}, {bobAddress, 5}, {aliceAddress, 10}},
+		nil,
+	}
+	payBob.Sign(alice)
+	prevHash := bc.latestBlock
+	err = bc.addNextBlock(10000, 0, []Transaction{testCoinbase(alice, prevHash), payBob})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobInputs := bc.GetOpenInputs(AddressFromKey(bob.PublicKey))
+	if len(bobInputs) != 2 || balance(bobInputs) != 15 {
+		t.Fatal("bob should have two open outputs:", bobInputs)
+	}
+
+	// Spending one of them leaves the other open.
+	first := OutPoint{payBob.Hash(), 0}
+	spend, _ := NewTransaction(map[OutPoint]int{first: 10}, bob, []Payment{{AddressFromKey(alice.PublicKey), 10}}, 0)
+	prevHash = bc.latestBlock
+	err = bc.addNextBlock(10000, 0, []Transaction{testCoinbase(alice, prevHash), *spend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobInputs = bc.GetOpenInputs(AddressFromKey(bob.PublicKey))
+	if len(bobInputs) != 1 || bobInputs[OutPoint{payBob.Hash(), 1}] != 5 {
+		t.Error("spending one output affected the other:", bobInputs)
+	}
+
+	// And the spent one can't be spent again.
+	if err := bc.Verify(spend); err == nil {
+		t.Error("output was spent twice")
+	}
+}
+
+func TestTransactionFees(t *testing.T) {
+	bc := newTestBlockChain()
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	coinbase := testCoinbase(alice, bc.latestBlock)
+	err := bc.addNextBlock(10000, 0, []Transaction{coinbase})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(bob.PublicKey), 10}}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fee, err := bc.verifyTransaction(tx)
+	if err != nil || fee != 3 {
+		t.Fatal("expected a fee of 3:", fee, err)
+	}
+
+	// Outputs can't exceed inputs.
+	overspend := Transaction{tx.Inputs, nil, []TxOut{{AddressFromKey(bob.PublicKey), 26}}, nil}
+	overspend.Sign(alice)
+	if err := bc.Verify(&overspend); err == nil {
+		t.Error("accepted a transaction creating coins")
+	}
+
+	// Nor can they get around that by overflowing.
+	bobAddress := AddressFromKey(bob.PublicKey)
+	overflow := Transaction{tx.Inputs, nil, []TxOut{{bobAddress, math.MaxInt64}, {bobAddress, math.MaxInt64}, {bobAddress, 3}}, nil}
+	overflow.Sign(alice)
+	if fee, err := bc.verifyTransaction(&overflow); err == nil {
+		t.Error("accepted outputs that overflow, with a fee of", fee)
+	}
+
+	// The miner can claim the fee on top of the block reward, but no
+	// more.
+	prevHash := bc.latestBlock
+	greedy := NewCoinbase(AddressFromKey(bob.PublicKey), prevHash, BlockReward+4)
+	if err := bc.addNextBlock(10000, 0, []Transaction{*greedy, *tx}); err == nil {
+		t.Error("accepted a coinbase claiming more than the fees")
+	}
+	miner := NewCoinbase(AddressFromKey(bob.PublicKey), prevHash, BlockReward+3)
+	if err := bc.addNextBlock(10000, 0, []Transaction{*miner, *tx}); err != nil {
+		t.Fatal(err)
+	}
+	if balance(bc.GetOpenInputs(AddressFromKey(bob.PublicKey))) != 10+BlockReward+3 {
+		t.Error("miner did not collect the fee")
+	}
+}
+
+func TestValidateBlockCoinbase(t *testing.T) {
+	bc := newTestBlockChain()
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	coinbase := testCoinbase(alice, bc.latestBlock)
+	if err := bc.addNextBlock(10000, 0, []Transaction{coinbase}); err != nil {
+		t.Fatal(err)
+	}
+	prevHash := bc.latestBlock
+	spend, _ := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(bob.PublicKey), 20}}, 5)
+
+	noInputs := Transaction{[]OutPoint{}, nil, []TxOut{{AddressFromKey(bob.PublicKey), 0}}, nil}
+	noInputs.Sign(bob)
+	wrongBlock := NewCoinbase(AddressFromKey(bob.PublicKey), coinbase.Hash(), BlockReward)
+	tooMuch := NewCoinbase(AddressFromKey(bob.PublicKey), prevHash, BlockReward+6)
+	negative := Transaction{
+		[]OutPoint{coinbaseInput(prevHash)},
+		nil,
+		[]TxOut{{AddressFromKey(bob.PublicKey), BlockReward + 10}, {AddressFromKey(alice.PublicKey), -10}},
+		nil,
+	}
+	overflow := Transaction{
+		[]OutPoint{coinbaseInput(prevHash)},
+		nil,
+		[]TxOut{{AddressFromKey(bob.PublicKey), math.MaxInt64}, {AddressFromKey(bob.PublicKey), math.MaxInt64}, {AddressFromKey(bob.PublicKey), 2}},
+		nil,
+	}
+	signed := testCoinbase(bob, prevHash)
+	signed.Sign(bob)
+
+	invalid := map[string][]Transaction{
+		"no transactions":       {},
+		"no coinbase":           {*spend},
+		"two coinbases":         {testCoinbase(bob, prevHash), testCoinbase(alice, prevHash)},
+		"coinbase not first":    {*spend, testCoinbase(bob, prevHash)},
+		"coinbase for another":  {*wrongBlock},
+		"coinbase too large":    {*tooMuch, *spend},
+		"negative coinbase":     {negative},
+		"overflowing coinbase":  {overflow},
+		"signed coinbase":       {signed},
+		"transaction no inputs": {testCoinbase(bob, prevHash), noInputs},
+	}
+	for name, transactions := range invalid {
+		// Blocks from peers and locally mined blocks are checked
+		// the same way.
+		block := mineTestBlock(&bc, prevHash, transactions)
+		if err := bc.addBlock(block); err == nil {
+			t.Errorf("%s: accepted block from a peer", name)
+		}
+		if err := bc.addNextBlock(10000, 0, transactions); err == nil {
+			t.Errorf("%s: mined block", name)
+		}
+		if bc.latestBlock != prevHash {
+			t.Fatalf("%s: tip moved", name)
+		}
+	}
+
+	exact := NewCoinbase(AddressFromKey(bob.PublicKey), prevHash, BlockReward+5)
+	block := mineTestBlock(&bc, prevHash, []Transaction{*exact, *spend})
+	if err := bc.addBlock(block); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDoubleSpendInOneBlock(t *testing.T) {
+	bc := newTestBlockChain()
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	coinbase := testCoinbase(alice, bc.latestBlock)
+	if err := bc.addNextBlock(10000, 0, []Transaction{coinbase}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both transactions verify on their own, but they spend the same
+	// coinbase.
+	toBob, _ := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(bob.PublicKey), 25}}, 0)
+	toAlice, _ := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(alice.PublicKey), 25}}, 0)
+	prevHash := bc.latestBlock
+	block := mineTestBlock(&bc, prevHash, []Transaction{testCoinbase(bob, prevHash), *toBob, *toAlice})
+
+	err := bc.addBlock(block)
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatal("expected a conflict error, got", err)
+	}
+	var invalid *BlockTransactionError
+	if !errors.As(err, &invalid) || invalid.Index != 2 {
+		t.Error("error does not give the conflicting transaction's index:", err)
+	}
+	if conflict.Tx != toAlice.Hash() || conflict.ConflictsWith != toBob.Hash() || conflict.OutPoint != toBob.Inputs[0] {
+		t.Error("conflict error names the wrong transactions:", conflict)
+	}
+	if bc.latestBlock != prevHash || balance(bc.GetOpenInputs(AddressFromKey(alice.PublicKey))) != 25 {
+		t.Error("rejected block changed the chain state")
+	}
+}
+
+func TestChainIndex(t *testing.T) {
+	bc := newTestBlockChain()
+	alice, _ := rsa.GenerateKey(rand.Reader, 1024)
+	bob, _ := rsa.GenerateKey(rand.Reader, 1024)
+	genesis := bc.latestBlock
+
+	// Alice's chain: genesis <- a1 <- a2
+	a1 := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(alice, genesis)})
+	if err := bc.addBlock(a1); err != nil {
+		t.Fatal(err)
+	}
+	a2 := mineTestBlock(&bc, a1.Hash(), []Transaction{testCoinbase(alice, a1.Hash())})
+	if err := bc.addBlock(a2); err != nil {
+		t.Fatal(err)
+	}
+
+	if tip, height := bc.Tip(); tip != a2.Hash() || height != 2 {
+		t.Errorf("got tip at height %d, want a2 at height 2", height)
+	}
+	for height, expected := range []SHA{genesis, a1.Hash(), a2.Hash()} {
+		block, err := bc.BlockAt(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Hash() != expected {
+			t.Errorf("wrong block at height %d", height)
+		}
+	}
+	if _, err := bc.BlockAt(3); err == nil {
+		t.Error("found a block above the tip")
+	}
+
+	aliceCoinbase := a1.Transactions[0].Hash()
+	if n := bc.Confirmations(aliceCoinbase); n != 2 {
+		t.Errorf("got %d confirmations, want 2", n)
+	}
+
+	// Bob's longer branch replaces Alice's.
+	b1 := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(bob, genesis)})
+	b2 := mineTestBlock(&bc, b1.Hash(), []Transaction{testCoinbase(bob, b1.Hash())})
+	b3 := mineTestBlock(&bc, b2.Hash(), []Transaction{testCoinbase(bob, b2.Hash())})
+	for _, block := range []Block{b1, b2, b3} {
+		if err := bc.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, height := bc.Tip(); height != 3 {
+		t.Errorf("got height %d after reorganizing, want 3", height)
+	}
+	if block, _ := bc.BlockAt(1); block.Hash() != b1.Hash() {
+		t.Error("main chain index was not updated by the reorganization")
+	}
+	if n := bc.Confirmations(aliceCoinbase); n != 0 {
+		t.Errorf("transaction on a side branch has %d confirmations", n)
+	}
+	if n := bc.Confirmations(b1.Transactions[0].Hash()); n != 3 {
+		t.Errorf("got %d confirmations, want 3", n)
+	}
+
+	// Ancestors work for blocks on either branch.
+	ancestors, err := bc.Ancestors(a2.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 2 || ancestors[0] != a1.Hash() || ancestors[1] != genesis {
+		t.Error("wrong ancestors for a side branch block")
+	}
+	ancestors, _ = bc.Ancestors(b3.Hash())
+	if len(ancestors) != 3 || ancestors[0] != b2.Hash() || ancestors[2] != genesis {
+		t.Error("wrong ancestors for the tip")
+	}
+	if _, err := bc.Ancestors(SHA{}); err == nil {
+		t.Error("found ancestors of an unknown block")
+	}
+}
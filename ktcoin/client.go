@@ -1,55 +1,124 @@
 package ktcoin
 
 import (
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
 	"fmt"
 	"net/rpc"
+	"time"
 )
 
-func SendTransaction(sender *rsa.PrivateKey, recipient *rsa.PublicKey, amount int) error {
-	// get valid input shas
-	// pick enough of them for amount or exit with error
-	// send tx
-	// communicate result
-	client, err := rpc.Dial("tcp", "localhost:8000")
+// The address clients connect to when no node is given.
+const DefaultNodeAddress = "localhost:" + DefaultPort
+
+// Fetches the open outputs of every key in the wallet from the node,
+// by label.
+func walletInputs(client *rpc.Client, wallet *Wallet) (map[string]map[OutPoint]int, error) {
+	open := make(map[string]map[OutPoint]int)
+	for _, k := range wallet.Keys() {
+		reply := make(map[OutPoint]int)
+		err := client.Call("BlockChainServer.GetOpenInputs", k.Address(), &reply)
+		if err != nil {
+			return nil, err
+		}
+		open[k.Label] = reply
+	}
+	return open, nil
+}
+
+// Sends the payments from the wallet, spending the open outputs of any
+// of its keys that the selector picks.
+func SendTransaction(node string, wallet *Wallet, payments []Payment, fee int, selector CoinSelector) error {
+	client, err := rpc.Dial("tcp", node)
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 
-	reply := make(map[SHA]int)
-	err = client.Call("BlockChainServer.GetOpenInputs", &sender.PublicKey, &reply)
-	fmt.Printf("Open Inputs: %v\n", reply)
+	open, err := walletInputs(client, wallet)
 	if err != nil {
 		return err
 	}
 
-	shas := make([]SHA, 0)
-	inputTotal := 0
-	for sha, inputAmount := range reply {
-		shas = append(shas, sha)
-		inputTotal += inputAmount
+	var success bool
+	tx, err := wallet.NewTransaction(open, payments, fee, selector)
+	if err != nil {
+		return err
 	}
+	fmt.Println("Inputs: ", tx.Inputs)
+	fmt.Println("Outputs: ", tx.Outputs)
 
-	var success bool
-	hashed, _ := bytesToSign(*recipient, shas)
-	signature, _ := rsa.SignPKCS1v15(rand.Reader, sender, crypto.SHA256, hashed[:])
-	outputs := make(map[string]int)
-	change := inputTotal - amount
-	if change > 0 {
-		outputs[publicKeyString(sender.PublicKey)] = change
+	err = client.Call("BlockChainServer.Transact", *tx, &success)
+	if err != nil {
+		return err
 	}
-	outputs[publicKeyString(*recipient)] = amount
 
-	tx := Transaction{shas, sender.PublicKey, *recipient, outputs, signature}
-	fmt.Println("Outputs: ", outputs)
+	fmt.Printf("Success? %v\n", success)
+	return nil
+}
 
-	err = client.Call("BlockChainServer.Transact", tx, &success)
+// Prints the balance of each key in the wallet and the wallet's total.
+func WalletBalance(node string, wallet *Wallet) error {
+	client, err := rpc.Dial("tcp", node)
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 
-	fmt.Printf("Success? %v", success)
+	open, err := walletInputs(client, wallet)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, k := range wallet.Keys() {
+		balance := 0
+		for _, amount := range open[k.Label] {
+			balance += amount
+		}
+		fmt.Printf("%s\t%s\t%d\t(%d open outputs)\n", k.Label, k.Address(), balance, len(open[k.Label]))
+		total += balance
+	}
+	fmt.Printf("total\t%d\n", total)
 	return nil
 }
+
+// Prints the peers the local node has connected to, with the version
+// each one reported.
+func ListPeers(node string) error {
+	client, err := rpc.Dial("tcp", node)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var peers []PeerInfo
+	err = client.Call("BlockChainServer.Peers", true, &peers)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		fmt.Printf("%s\t%s\t%s\theight %d\tlast seen %s\n",
+			peer.Address, peer.Status, peer.Version.UserAgent, peer.Version.BestHeight,
+			peer.LastSeen.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Adds a peer to the local node's address table.
+func AddPeer(node string, address string) error {
+	return callNode(node, "BlockChainServer.AddPeer", address)
+}
+
+// Removes a peer from the local node's address table.
+func RemovePeer(node string, address string) error {
+	return callNode(node, "BlockChainServer.RemovePeer", address)
+}
+
+func callNode(node string, method string, address string) error {
+	client, err := rpc.Dial("tcp", node)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var done bool
+	return client.Call(method, address, &done)
+}
@@ -0,0 +1,165 @@
+package ktcoin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// The most combinations of inputs branch and bound tries before
+// settling for the best it has found.
+const BranchAndBoundMaxTries = 100000
+
+// A CoinSelector picks which of the candidate outputs to spend in a
+// transaction needing target coins.  The outputs it picks add up to at
+// least target; anything over becomes change.
+type CoinSelector func(candidates []SpendableOutput, target int) ([]SpendableOutput, error)
+
+// The coin selection strategies, by name.
+//
+//   - largest-first spends the biggest outputs until the target is
+//     covered, using as few inputs as possible.
+//   - branch-and-bound searches for the combination of outputs that
+//     leaves the least change, ideally none.
+//   - smallest-sufficient spends the single smallest output that
+//     covers the target, or falls back to largest-first if no one
+//     output is big enough.
+var CoinSelectors = map[string]CoinSelector{
+	"largest-first":       SelectLargestFirst,
+	"branch-and-bound":    SelectBranchAndBound,
+	"smallest-sufficient": SelectSmallestSufficient,
+}
+
+// The strategy used when none is chosen.
+const DefaultCoinSelector = "largest-first"
+
+// Returns the coin selection strategy with the given name.
+func CoinSelectorByName(name string) (CoinSelector, error) {
+	selector, ok := CoinSelectors[name]
+	if !ok {
+		names := make([]string, 0, len(CoinSelectors))
+		for name := range CoinSelectors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown coin selection %q (choose from %s)", name, strings.Join(names, ", "))
+	}
+	return selector, nil
+}
+
+func insufficientFunds(target int, available int) error {
+	return fmt.Errorf("%w: need %d coins, but only %d are available", ErrInsufficientFunds, target, available)
+}
+
+// Returns the candidates sorted from largest to smallest amount.  Equal
+// amounts are ordered by outpoint, so selection is deterministic.
+func sortedByAmount(candidates []SpendableOutput) []SpendableOutput {
+	sorted := append([]SpendableOutput{}, candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Amount != sorted[j].Amount {
+			return sorted[i].Amount > sorted[j].Amount
+		}
+		c := bytes.Compare(sorted[i].OutPoint.Hash[:], sorted[j].OutPoint.Hash[:])
+		if c != 0 {
+			return c < 0
+		}
+		return sorted[i].OutPoint.Index < sorted[j].OutPoint.Index
+	})
+	return sorted
+}
+
+func totalAmount(outputs []SpendableOutput) int {
+	total := 0
+	for _, output := range outputs {
+		total += output.Amount
+	}
+	return total
+}
+
+func SelectLargestFirst(candidates []SpendableOutput, target int) ([]SpendableOutput, error) {
+	sorted := sortedByAmount(candidates)
+	total := 0
+	for i, candidate := range sorted {
+		if total >= target && i > 0 {
+			return sorted[:i], nil
+		}
+		total += candidate.Amount
+	}
+	if total < target {
+		return nil, insufficientFunds(target, total)
+	}
+	return sorted, nil
+}
+
+func SelectSmallestSufficient(candidates []SpendableOutput, target int) ([]SpendableOutput, error) {
+	sorted := sortedByAmount(candidates)
+	// The smallest output covering the target is the last one that
+	// does, since they're sorted largest first.
+	i := sort.Search(len(sorted), func(i int) bool {
+		return sorted[i].Amount < target
+	})
+	if i > 0 {
+		return sorted[i-1 : i], nil
+	}
+	return SelectLargestFirst(candidates, target)
+}
+
+// Searches depth first through the outputs, largest first, for the
+// combination that covers the target with the least left over.  A
+// branch is abandoned as soon as it covers the target, since adding
+// more would only add change, or when it can't reach the target even
+// with every remaining output.  The search stops at an exact match or
+// after BranchAndBoundMaxTries steps.
+func SelectBranchAndBound(candidates []SpendableOutput, target int) ([]SpendableOutput, error) {
+	sorted := sortedByAmount(candidates)
+	available := totalAmount(sorted)
+	if available < target {
+		return nil, insufficientFunds(target, available)
+	}
+
+	// remaining[i] is the total of sorted[i:].
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Amount
+	}
+
+	var best []int
+	bestExcess := -1
+	chosen := make([]int, 0, len(sorted))
+	tries := 0
+	var search func(i int, total int)
+	search = func(i int, total int) {
+		tries++
+		if bestExcess == 0 || tries > BranchAndBoundMaxTries {
+			return
+		}
+		if total >= target {
+			if excess := total - target; bestExcess < 0 || excess < bestExcess {
+				bestExcess = excess
+				best = append(best[:0], chosen...)
+			}
+			return
+		}
+		if i == len(sorted) || total+remaining[i] < target {
+			return
+		}
+		chosen = append(chosen, i)
+		search(i+1, total+sorted[i].Amount)
+		chosen = chosen[:len(chosen)-1]
+		search(i+1, total)
+	}
+	search(0, 0)
+
+	if best == nil {
+		return SelectLargestFirst(candidates, target)
+	}
+	selected := make([]SpendableOutput, 0, len(best))
+	for _, i := range best {
+		selected = append(selected, sorted[i])
+	}
+	return selected, nil
+}
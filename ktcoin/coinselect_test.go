@@ -0,0 +1,82 @@
+package ktcoin
+
+import (
+	"errors"
+	"sort"
+	"testing"
+)
+
+// Returns outputs with the given amounts, each with its own outpoint.
+func testOutputs(amounts ...int) []SpendableOutput {
+	outputs := make([]SpendableOutput, 0, len(amounts))
+	for i, amount := range amounts {
+		outputs = append(outputs, SpendableOutput{OutPoint{SHA{byte(i + 1)}, 0}, amount, nil})
+	}
+	return outputs
+}
+
+func selectedAmounts(selected []SpendableOutput) []int {
+	amounts := make([]int, 0, len(selected))
+	for _, output := range selected {
+		amounts = append(amounts, output.Amount)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(amounts)))
+	return amounts
+}
+
+func TestCoinSelection(t *testing.T) {
+	candidates := testOutputs(1, 5, 8, 12, 20)
+	cases := []struct {
+		selector string
+		target   int
+		want     []int
+	}{
+		{"largest-first", 25, []int{20, 12}},
+		{"largest-first", 20, []int{20}},
+		{"largest-first", 46, []int{20, 12, 8, 5, 1}},
+		{"branch-and-bound", 25, []int{20, 5}},
+		{"branch-and-bound", 14, []int{8, 5, 1}},
+		{"branch-and-bound", 2, []int{5}},
+		{"smallest-sufficient", 10, []int{12}},
+		{"smallest-sufficient", 8, []int{8}},
+		{"smallest-sufficient", 30, []int{20, 12}},
+	}
+	for _, c := range cases {
+		selector, err := CoinSelectorByName(c.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selected, err := selector(candidates, c.target)
+		if err != nil {
+			t.Errorf("%s for %d: %v", c.selector, c.target, err)
+			continue
+		}
+		got := selectedAmounts(selected)
+		if len(got) != len(c.want) {
+			t.Errorf("%s for %d: got %v, want %v", c.selector, c.target, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s for %d: got %v, want %v", c.selector, c.target, got, c.want)
+				break
+			}
+		}
+	}
+
+	if _, err := CoinSelectorByName("random"); err == nil {
+		t.Error("accepted an unknown strategy")
+	}
+}
+
+func TestInsufficientFunds(t *testing.T) {
+	candidates := testOutputs(3, 4)
+	for name, selector := range CoinSelectors {
+		if _, err := selector(candidates, 8); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("%s: expected insufficient funds, got %v", name, err)
+		}
+		if _, err := selector(nil, 1); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("%s: expected insufficient funds with no outputs, got %v", name, err)
+		}
+	}
+}
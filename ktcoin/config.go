@@ -0,0 +1,173 @@
+package ktcoin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"time"
+)
+
+// Everything needed to run a node.  A config starts out as
+// DefaultConfig, is overridden by a config file if one is given, and
+// then by any command line flags.  The HTTP API is only served if
+// APIAddress is set.
+type Config struct {
+	ListenAddress string
+	APIAddress    string
+	Peers         []string
+	KeyFile       string
+	DataDir       string
+	Mining        bool
+	Workers       int
+	Chain         ChainParams
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddress: ":" + DefaultPort,
+		APIAddress:    "",
+		Peers:         nil,
+		KeyFile:       "id_rsa",
+		DataDir:       "ktcoin-data",
+		Mining:        true,
+		Workers:       runtime.NumCPU(),
+		Chain:         DefaultChainParams,
+	}
+}
+
+// The JSON form of a config file.  Every setting is optional; settings
+// left out keep their current values.
+//
+//	{
+//	  "listen": "127.0.0.1:8001",
+//	  "api": "127.0.0.1:8081",
+//	  "peers": ["127.0.0.1:8002"],
+//	  "key": "node1/id_rsa",
+//	  "datadir": "node1/data",
+//	  "mining": true,
+//	  "workers": 2,
+//	  "difficulty": {
+//	    "pow_limit_bits": 536936447,
+//	    "initial_bits": 520159231,
+//	    "retarget_interval": 20,
+//	    "target_spacing": "30s",
+//	    "max_adjustment": 4
+//	  }
+//	}
+type configFile struct {
+	Listen     *string  `json:"listen"`
+	API        *string  `json:"api"`
+	Peers      []string `json:"peers"`
+	Key        *string  `json:"key"`
+	DataDir    *string  `json:"datadir"`
+	Mining     *bool    `json:"mining"`
+	Workers    *int     `json:"workers"`
+	Difficulty *struct {
+		PowLimitBits     *uint32 `json:"pow_limit_bits"`
+		InitialBits      *uint32 `json:"initial_bits"`
+		RetargetInterval *int    `json:"retarget_interval"`
+		TargetSpacing    *string `json:"target_spacing"`
+		MaxAdjustment    *int64  `json:"max_adjustment"`
+	} `json:"difficulty"`
+}
+
+// Overrides the config with the settings in a JSON config file.
+func (cfg *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file configFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	if file.Listen != nil {
+		cfg.ListenAddress = *file.Listen
+	}
+	if file.API != nil {
+		cfg.APIAddress = *file.API
+	}
+	cfg.Peers = append(cfg.Peers, file.Peers...)
+	if file.Key != nil {
+		cfg.KeyFile = *file.Key
+	}
+	if file.DataDir != nil {
+		cfg.DataDir = *file.DataDir
+	}
+	if file.Mining != nil {
+		cfg.Mining = *file.Mining
+	}
+	if file.Workers != nil {
+		cfg.Workers = *file.Workers
+	}
+
+	if d := file.Difficulty; d != nil {
+		if d.PowLimitBits != nil {
+			cfg.Chain.PowLimitBits = *d.PowLimitBits
+		}
+		if d.InitialBits != nil {
+			cfg.Chain.InitialBits = *d.InitialBits
+		}
+		if d.RetargetInterval != nil {
+			cfg.Chain.RetargetInterval = *d.RetargetInterval
+		}
+		if d.TargetSpacing != nil {
+			spacing, err := time.ParseDuration(*d.TargetSpacing)
+			if err != nil {
+				return fmt.Errorf("%s: target_spacing: %v", path, err)
+			}
+			cfg.Chain.TargetSpacing = spacing
+		}
+		if d.MaxAdjustment != nil {
+			cfg.Chain.MaxAdjustment = *d.MaxAdjustment
+		}
+	}
+	return nil
+}
+
+// Checks that the config describes a node that can run.
+func (cfg *Config) Validate() error {
+	if cfg.ListenAddress == "" {
+		return errors.New("no listen address")
+	}
+	if cfg.KeyFile == "" {
+		return errors.New("no key file")
+	}
+	if cfg.DataDir == "" {
+		return errors.New("no data directory")
+	}
+	if cfg.Mining && cfg.Workers < 1 {
+		return errors.New("mining needs at least one worker")
+	}
+	for _, peer := range cfg.Peers {
+		if _, err := normalizeAddress(peer); err != nil {
+			return fmt.Errorf("peer %q: %v", peer, err)
+		}
+	}
+	return cfg.Chain.Validate()
+}
+
+func (params *ChainParams) Validate() error {
+	powLimit := CompactToBig(params.PowLimitBits)
+	if powLimit.Sign() <= 0 {
+		return errors.New("proof of work limit must be positive")
+	}
+	initial := CompactToBig(params.InitialBits)
+	if initial.Sign() <= 0 || initial.Cmp(powLimit) > 0 {
+		return errors.New("initial target must be positive and no easier than the limit")
+	}
+	if params.RetargetInterval < 1 {
+		return errors.New("retarget interval must be at least one block")
+	}
+	if params.TargetSpacing < time.Second {
+		return errors.New("target spacing must be at least a second")
+	}
+	if params.MaxAdjustment < 1 {
+		return errors.New("maximum adjustment must be at least 1")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package ktcoin
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"listen": "127.0.0.1:8001",
+		"peers": ["127.0.0.1:8002"],
+		"datadir": "node1",
+		"mining": false,
+		"difficulty": {
+			"initial_bits": 536936447,
+			"target_spacing": "1m"
+		}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Peers = []string{"seed"}
+	if err := cfg.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddress != "127.0.0.1:8001" || cfg.DataDir != "node1" || cfg.Mining {
+		t.Error("settings from the file were not applied:", cfg)
+	}
+	if len(cfg.Peers) != 2 || cfg.Peers[1] != "127.0.0.1:8002" {
+		t.Error("peers from the file were not added:", cfg.Peers)
+	}
+	if cfg.KeyFile != "id_rsa" || cfg.Workers != DefaultConfig().Workers {
+		t.Error("settings missing from the file were changed")
+	}
+	if cfg.Chain.InitialBits != 0x2000ffff || cfg.Chain.TargetSpacing != time.Minute {
+		t.Error("difficulty settings were not applied:", cfg.Chain)
+	}
+	if cfg.Chain.RetargetInterval != DefaultChainParams.RetargetInterval {
+		t.Error("difficulty settings missing from the file were changed")
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if cfg := DefaultConfig(); cfg.Validate() != nil {
+		t.Error("default config is invalid")
+	}
+
+	invalid := map[string]func(*Config){
+		"no listen address":      func(cfg *Config) { cfg.ListenAddress = "" },
+		"mining without workers": func(cfg *Config) { cfg.Workers = 0 },
+		"bad peer":               func(cfg *Config) { cfg.Peers = []string{":8000"} },
+		"target above the limit": func(cfg *Config) { cfg.Chain.InitialBits = 0x2100ffff },
+		"no retarget interval":   func(cfg *Config) { cfg.Chain.RetargetInterval = 0 },
+		"no target spacing":      func(cfg *Config) { cfg.Chain.TargetSpacing = 0 },
+	}
+	for name, change := range invalid {
+		cfg := DefaultConfig()
+		change(&cfg)
+		if cfg.Validate() == nil {
+			t.Errorf("%s: accepted an invalid config", name)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.Mining = false
+	cfg.Workers = 0
+	if err := cfg.Validate(); err != nil {
+		t.Error("workers should only matter when mining:", err)
+	}
+}
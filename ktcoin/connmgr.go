@@ -0,0 +1,315 @@
+package ktcoin
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/rpc"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The most peers a node keeps connections to.
+const MaxPeerConnections = 8
+
+// How many messages may wait to be sent to one peer.  Once a peer's
+// queue is full, senders wait up to PeerQueueTimeout for room before
+// giving up on that peer, except for broadcasts, which skip it.
+const (
+	PeerQueueSize    = 64
+	PeerQueueTimeout = time.Second
+)
+
+// How often an idle connection is checked with a ping, and how long
+// any call to a peer may take before the connection is considered dead.
+const (
+	PingInterval    = 30 * time.Second
+	PeerCallTimeout = 30 * time.Second
+)
+
+var (
+	errPeerDown    = errors.New("peer is not connected")
+	errPeerTimeout = errors.New("peer did not respond in time")
+)
+
+// Something to do with a peer's connection, such as sending it a block.
+// Tasks for a peer run one at a time, in the order they were queued.
+type peerTask func(client *rpc.Client) error
+
+type queuedTask struct {
+	task peerTask
+	done chan error
+}
+
+// A connection error means the connection to a peer is no longer
+// usable, as opposed to the peer returning an error from a call.
+type connError struct {
+	err error
+}
+
+func (e *connError) Error() string {
+	return e.err.Error()
+}
+
+// Calls a method on a peer, giving up after PeerCallTimeout.  Errors
+// other than those returned by the method itself are connection
+// errors.
+func callPeer(client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if _, ok := call.Error.(rpc.ServerError); ok || call.Error == nil {
+			return call.Error
+		}
+		return &connError{call.Error}
+	case <-time.After(PeerCallTimeout):
+		return &connError{errPeerTimeout}
+	}
+}
+
+type peerConn struct {
+	addr      string
+	tasks     chan queuedTask
+	quit      chan struct{}
+	connected int32
+}
+
+// Fails every task still waiting in the queue.
+func (pc *peerConn) drop() {
+	for {
+		select {
+		case queued := <-pc.tasks:
+			if queued.done != nil {
+				queued.done <- errPeerDown
+			}
+		default:
+			return
+		}
+	}
+}
+
+// The ConnManager keeps one long-lived connection to each peer it's
+// asked to connect to.  Each connection has its own goroutine and
+// queue of outbound tasks, so a slow or dead peer only holds up its
+// own queue.  Idle connections are pinged, and a connection that fails
+// is closed and redialed with backoff until the peer is disconnected.
+type ConnManager struct {
+	mu           sync.Mutex
+	conns        map[string]*peerConn
+	dial         func(addr string) (*rpc.Client, error)
+	onConnect    func(addr string)
+	onDisconnect func(addr string, err error)
+	running      sync.WaitGroup
+}
+
+func NewConnManager(dial func(string) (*rpc.Client, error), onConnect func(string), onDisconnect func(string, error)) *ConnManager {
+	return &ConnManager{
+		conns:        make(map[string]*peerConn),
+		dial:         dial,
+		onConnect:    onConnect,
+		onDisconnect: onDisconnect,
+	}
+}
+
+// Starts keeping a connection to addr, unless we already are or have
+// as many connections as we want.  Returns true if there is now a
+// connection (or an attempt at one) to addr.
+func (cm *ConnManager) Connect(addr string) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, ok := cm.conns[addr]; ok {
+		return true
+	}
+	if len(cm.conns) >= MaxPeerConnections {
+		return false
+	}
+	pc := &peerConn{addr: addr, tasks: make(chan queuedTask, PeerQueueSize), quit: make(chan struct{})}
+	cm.conns[addr] = pc
+	cm.running.Add(1)
+	go cm.run(pc)
+	return true
+}
+
+// Closes the connection to addr and stops reconnecting to it.
+func (cm *ConnManager) Disconnect(addr string) {
+	cm.mu.Lock()
+	pc, ok := cm.conns[addr]
+	delete(cm.conns, addr)
+	cm.mu.Unlock()
+	if ok {
+		close(pc.quit)
+	}
+}
+
+// Disconnects from every peer and waits for their connections to close.
+func (cm *ConnManager) Close() {
+	cm.mu.Lock()
+	conns := cm.conns
+	cm.conns = make(map[string]*peerConn)
+	cm.mu.Unlock()
+	for _, pc := range conns {
+		close(pc.quit)
+	}
+	cm.running.Wait()
+}
+
+// Returns the peers we're currently connected to.
+func (cm *ConnManager) Connected() []string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	addrs := make([]string, 0, len(cm.conns))
+	for addr, pc := range cm.conns {
+		if atomic.LoadInt32(&pc.connected) == 1 {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Returns every peer we're connected or trying to connect to.
+func (cm *ConnManager) Peers() []string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	addrs := make([]string, 0, len(cm.conns))
+	for addr := range cm.conns {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Queues a task for a peer without waiting for it to run.
+func (cm *ConnManager) Send(addr string, task peerTask) error {
+	return cm.enqueue(addr, queuedTask{task, nil}, PeerQueueTimeout)
+}
+
+// Queues a task for a peer and waits for its result.
+func (cm *ConnManager) Do(addr string, task peerTask) error {
+	done := make(chan error, 1)
+	err := cm.enqueue(addr, queuedTask{task, done}, PeerQueueTimeout)
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// Queues a task for every connected peer without waiting, so that a
+// peer that has stopped keeping up doesn't delay the others.  Peers
+// whose queues are full are skipped.
+func (cm *ConnManager) Broadcast(task peerTask) {
+	for _, addr := range cm.Connected() {
+		err := cm.enqueue(addr, queuedTask{task, nil}, 0)
+		if err != nil {
+			fmt.Printf("Could not send to %s: %v\n", addr, err)
+		}
+	}
+}
+
+var errQueueFull = errors.New("peer's send queue is full")
+
+func (cm *ConnManager) enqueue(addr string, queued queuedTask, wait time.Duration) error {
+	cm.mu.Lock()
+	pc, ok := cm.conns[addr]
+	cm.mu.Unlock()
+	if !ok || atomic.LoadInt32(&pc.connected) == 0 {
+		return errPeerDown
+	}
+
+	select {
+	case pc.tasks <- queued:
+		return nil
+	default:
+	}
+	if wait == 0 {
+		return errQueueFull
+	}
+	select {
+	case pc.tasks <- queued:
+		return nil
+	case <-pc.quit:
+		return errPeerDown
+	case <-time.After(wait):
+		return errQueueFull
+	}
+}
+
+// Keeps a peer connected until it's disconnected, redialing with
+// backoff whenever the connection fails.
+func (cm *ConnManager) run(pc *peerConn) {
+	defer cm.running.Done()
+	failures := 0
+	for {
+		client, err := cm.dial(pc.addr)
+		if err == nil {
+			failures = 0
+			atomic.StoreInt32(&pc.connected, 1)
+			if cm.onConnect != nil {
+				cm.onConnect(pc.addr)
+			}
+			err = cm.serve(pc, client)
+			atomic.StoreInt32(&pc.connected, 0)
+			client.Close()
+			pc.drop()
+			if err == nil {
+				return
+			}
+			if cm.onDisconnect != nil {
+				cm.onDisconnect(pc.addr, err)
+			}
+		} else {
+			failures++
+		}
+
+		select {
+		case <-time.After(retryInterval(failures)):
+		case <-pc.quit:
+			pc.drop()
+			return
+		}
+	}
+}
+
+// Runs a connected peer's queued tasks and pings it when it's idle.
+// Returns nil once the peer is disconnected, or the error that broke
+// the connection.
+func (cm *ConnManager) serve(pc *peerConn, client *rpc.Client) error {
+	ping := time.NewTicker(PingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case queued := <-pc.tasks:
+			err := queued.task(client)
+			if queued.done != nil {
+				queued.done <- err
+			} else if err != nil {
+				fmt.Printf("Sending to %s failed: %v\n", pc.addr, err)
+			}
+			if _, ok := err.(*connError); ok {
+				return err
+			}
+		case <-ping.C:
+			err := pingPeer(client)
+			if err != nil {
+				return err
+			}
+		case <-pc.quit:
+			return nil
+		}
+	}
+}
+
+func pingPeer(client *rpc.Client) error {
+	nonce := rand.Uint64()
+	var pong uint64
+	err := callPeer(client, "BlockChainServer.Ping", nonce, &pong)
+	if err != nil {
+		return err
+	}
+	if pong != nonce {
+		return &connError{errors.New("peer answered ping with the wrong nonce")}
+	}
+	return nil
+}
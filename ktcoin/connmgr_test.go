@@ -0,0 +1,155 @@
+package ktcoin
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+type pingService struct{}
+
+func (pingService) Ping(nonce uint64, pong *uint64) error {
+	*pong = nonce
+	return nil
+}
+
+// A peer that answers pings and can drop every connection made to it.
+type testPeer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestPeer(t *testing.T) *testPeer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rpc.NewServer()
+	server.RegisterName("BlockChainServer", pingService{})
+	peer := &testPeer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			peer.mu.Lock()
+			peer.conns = append(peer.conns, conn)
+			peer.mu.Unlock()
+			go server.ServeConn(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return peer
+}
+
+func (p *testPeer) dropConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func dialTestPeer(addr string) (*rpc.Client, error) {
+	if addr == "dead" {
+		return nil, errors.New("connection refused")
+	}
+	return rpc.Dial("tcp", addr)
+}
+
+func waitConnected(t *testing.T, cm *ConnManager, addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, connected := range cm.Connected() {
+			if connected == addr {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("never connected to", addr)
+}
+
+func TestConnManagerReconnects(t *testing.T) {
+	peer := newTestPeer(t)
+	addr := peer.ln.Addr().String()
+	connects := make(chan string, 10)
+	cm := NewConnManager(dialTestPeer, func(addr string) { connects <- addr }, nil)
+	defer cm.Close()
+
+	cm.Connect(addr)
+	waitConnected(t, cm, addr)
+	if err := cm.Do(addr, pingPeer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection breaks; the next call fails and the manager
+	// dials the peer again.
+	peer.dropConnections()
+	if err := cm.Do(addr, pingPeer); err == nil {
+		t.Fatal("ping succeeded over a closed connection")
+	}
+	waitConnected(t, cm, addr)
+	if err := cm.Do(addr, pingPeer); err != nil {
+		t.Fatal(err)
+	}
+	if len(connects) != 2 {
+		t.Errorf("connected %d times, want 2", len(connects))
+	}
+
+	cm.Disconnect(addr)
+	if err := cm.Do(addr, pingPeer); err != errPeerDown {
+		t.Error("sent to a disconnected peer:", err)
+	}
+}
+
+func TestBroadcastSkipsStuckPeers(t *testing.T) {
+	stuck := newTestPeer(t)
+	good := newTestPeer(t)
+	stuckAddr := stuck.ln.Addr().String()
+	goodAddr := good.ln.Addr().String()
+
+	cm := NewConnManager(dialTestPeer, nil, nil)
+	defer cm.Close()
+	cm.Connect("dead")
+	cm.Connect(stuckAddr)
+	cm.Connect(goodAddr)
+	waitConnected(t, cm, stuckAddr)
+	waitConnected(t, cm, goodAddr)
+
+	// Wedge the stuck peer's connection and fill its queue.
+	release := make(chan struct{})
+	defer close(release)
+	cm.Send(stuckAddr, func(*rpc.Client) error {
+		<-release
+		return nil
+	})
+	for i := 0; i < PeerQueueSize; i++ {
+		cm.Send(stuckAddr, func(*rpc.Client) error { return nil })
+	}
+
+	received := make(chan string, 3)
+	start := time.Now()
+	cm.Broadcast(func(client *rpc.Client) error {
+		received <- "ok"
+		return pingPeer(client)
+	})
+	if elapsed := time.Since(start); elapsed > PeerQueueTimeout/2 {
+		t.Errorf("broadcast waited %v for a stuck peer", elapsed)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("healthy peer never received the broadcast")
+	}
+	if connected := cm.Connected(); len(connected) != 2 {
+		t.Error("dead peer reported as connected:", connected)
+	}
+}
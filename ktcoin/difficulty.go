@@ -0,0 +1,201 @@
+package ktcoin
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// The parameters controlling how hard it is to mine a block.  Every
+// RetargetInterval blocks, the target is adjusted so that blocks are
+// found TargetSpacing apart on average, but it never changes by more
+// than a factor of MaxAdjustment at once and never gets easier than
+// the target encoded by PowLimitBits.
+type ChainParams struct {
+	PowLimitBits     uint32
+	InitialBits      uint32
+	RetargetInterval int
+	TargetSpacing    time.Duration
+	MaxAdjustment    int64
+}
+
+var DefaultChainParams = ChainParams{
+	PowLimitBits:     0x2000ffff, // one leading zero byte
+	InitialBits:      0x1f00ffff, // two leading zero bytes
+	RetargetInterval: 20,
+	TargetSpacing:    30 * time.Second,
+	MaxAdjustment:    4,
+}
+
+// The timestamp of the genesis block.
+const GenesisTimestamp = 1475280000
+
+// How far ahead of our own clock a block's timestamp may be.
+const MaxFutureBlockTime = 2 * time.Hour
+
+// The number of previous blocks whose median timestamp a new block
+// must be later than.
+const MedianTimeBlocks = 11
+
+// Converts a compact target, as stored in a block, to the full 256-bit
+// number.  The compact form is a base-256 floating point number: the
+// top byte is the length of the number in bytes and the low three
+// bytes are its most significant bytes.  Bit 23 is a sign bit, which
+// is never set for a valid target.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	exponent := uint(compact >> 24)
+
+	var n *big.Int
+	if exponent <= 3 {
+		n = big.NewInt(mantissa >> (8 * (3 - exponent)))
+	} else {
+		n = new(big.Int).Lsh(big.NewInt(mantissa), 8*(exponent-3))
+	}
+	if compact&0x00800000 != 0 {
+		n.Neg(n)
+	}
+	return n
+}
+
+// Converts a 256-bit target to its compact form, losing all but the
+// most significant three bytes.
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	exponent := uint(len(n.Bytes()))
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(n).Uint64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(new(big.Int).Abs(n), 8*(exponent-3)).Uint64())
+	}
+
+	// Keep the sign bit clear by moving to a larger exponent.
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+var twoTo256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// The amount of work represented by a block with the given target: the
+// expected number of hashes needed to find it.
+func blockWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Div(twoTo256, target.Add(target, big.NewInt(1)))
+}
+
+// Returns true if a hash, read as a big-endian 256-bit number, is no
+// greater than the target.
+func hashMeetsTarget(hash SHA, target *big.Int) bool {
+	return new(big.Int).SetBytes(hash[:]).Cmp(target) <= 0
+}
+
+// Returns the ancestor of a block the given number of blocks back,
+// stopping at the genesis block.
+func (bc *BlockChain) ancestor(sha SHA, back int) SHA {
+	for i := 0; i < back && bc.index[sha].height > 0; i++ {
+		sha = bc.index[sha].parent
+	}
+	return sha
+}
+
+// The target that a block following prevHash must use.  The target
+// stays the same within a retarget interval; at the start of each new
+// interval it's scaled by how long the previous interval actually took
+// compared to how long it should have taken.  The genesis block's
+// timestamp is fixed long before anyone mines on a new chain, so the
+// first interval is measured from block 1 instead, and is one block
+// shorter.
+func (bc *BlockChain) nextBits(prevHash SHA) uint32 {
+	prev := bc.blocks[prevHash]
+	height := bc.index[prevHash].height + 1
+	if height%bc.params.RetargetInterval != 0 {
+		return prev.Bits
+	}
+
+	firstSha := bc.ancestor(prevHash, bc.params.RetargetInterval)
+	if bc.index[firstSha].height == 0 {
+		firstSha = bc.ancestor(prevHash, height-2)
+	}
+	spacings := int64(height - 1 - bc.index[firstSha].height)
+	if spacings <= 0 {
+		return prev.Bits
+	}
+	first := bc.blocks[firstSha]
+	expected := spacings * int64(bc.params.TargetSpacing/time.Second)
+	actual := prev.Timestamp - first.Timestamp
+	if actual < expected/bc.params.MaxAdjustment {
+		actual = expected / bc.params.MaxAdjustment
+	}
+	if actual > expected*bc.params.MaxAdjustment {
+		actual = expected * bc.params.MaxAdjustment
+	}
+
+	target := CompactToBig(prev.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	powLimit := CompactToBig(bc.params.PowLimitBits)
+	if target.Cmp(powLimit) > 0 {
+		target = powLimit
+	}
+	return BigToCompact(target)
+}
+
+// The median timestamp of the last MedianTimeBlocks blocks ending at
+// sha.  A new block's timestamp must be later than this, which keeps
+// timestamps moving forward without requiring every block to be later
+// than its parent.
+func (bc *BlockChain) medianTimePast(sha SHA) int64 {
+	timestamps := make([]int64, 0, MedianTimeBlocks)
+	for i := 0; i < MedianTimeBlocks; i++ {
+		timestamps = append(timestamps, bc.blocks[sha].Timestamp)
+		if bc.index[sha].height == 0 {
+			break
+		}
+		sha = bc.index[sha].parent
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// Checks a block's timestamp, target and proof of work.  Unlike
+// ValidateBlock, this only depends on the block's ancestors, so it can
+// be checked for blocks on side branches as soon as they arrive.
+func (bc *BlockChain) checkHeader(block *Block) error {
+	expectedBits := bc.nextBits(block.PrevHash)
+	if block.Bits != expectedBits {
+		return fmt.Errorf("block has target %08x, expected %08x", block.Bits, expectedBits)
+	}
+
+	if block.Timestamp <= bc.medianTimePast(block.PrevHash) {
+		return errors.New("block timestamp is too early")
+	}
+	if block.Timestamp > time.Now().Add(MaxFutureBlockTime).Unix() {
+		return errors.New("block timestamp is too far in the future")
+	}
+
+	target := CompactToBig(block.Bits)
+	if target.Sign() <= 0 || target.Cmp(CompactToBig(bc.params.PowLimitBits)) > 0 {
+		return errors.New("block target is out of range")
+	}
+	if !hashMeetsTarget(block.Hash(), target) {
+		return errors.New("block hash does not satisfy proof of work")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package ktcoin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	vectors := []struct {
+		compact uint32
+		target  string
+	}{
+		{0x1d00ffff, "ffff" + strings.Repeat("00", 26)},
+		{0x2000ffff, "ffff" + strings.Repeat("00", 29)},
+		{0x1f3fffc0, "3fffc0" + strings.Repeat("00", 28)},
+		{0x03123456, "123456"},
+		{0x02123400, "1234"},
+	}
+	for _, v := range vectors {
+		target := CompactToBig(v.compact)
+		if target.Text(16) != v.target {
+			t.Errorf("%08x: got target %s, want %s", v.compact, target.Text(16), v.target)
+		}
+		if compact := BigToCompact(target); compact != v.compact {
+			t.Errorf("%s: got compact %08x, want %08x", v.target, compact, v.compact)
+		}
+	}
+
+	// A mantissa with the top bit set moves to a larger exponent.
+	if compact := BigToCompact(big.NewInt(0x80)); compact != 0x02008000 {
+		t.Errorf("got %08x, want 02008000", compact)
+	}
+}
+
+// Builds a chain of blocks mined spacing seconds apart, returning the chain and the
+// bits the next block must use.
+func retargetChain(t *testing.T, params ChainParams, blocks int, spacing int64) (*BlockChain, uint32) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	bc := NewBlockChainWithParams(params)
+	for i := 0; i < blocks; i++ {
+		prevHash := bc.latestBlock
+		block := NewBlock(
+			prevHash,
+			bc.blocks[prevHash].Timestamp+spacing,
+			bc.nextBits(prevHash),
+			0,
+			[]Transaction{testCoinbase(key, prevHash)},
+		)
+		for !block.isValid() {
+			block.Nonce++
+		}
+		if err := bc.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &bc, bc.nextBits(bc.latestBlock)
+}
+
+func TestRetarget(t *testing.T) {
+	params := ChainParams{
+		PowLimitBits:     0x2000ffff,
+		InitialBits:      0x1f3fffc0,
+		RetargetInterval: 4,
+		TargetSpacing:    30 * time.Second,
+		MaxAdjustment:    4,
+	}
+	initial := CompactToBig(params.InitialBits)
+
+	// Blocks found instantly make the target as much harder as allowed.
+	bc, bits := retargetChain(t, params, 3, 1)
+	if bc.blocks[bc.latestBlock].Bits != params.InitialBits {
+		t.Error("target changed before the retarget interval")
+	}
+	expected := new(big.Int).Div(initial, big.NewInt(4))
+	if bits != BigToCompact(expected) {
+		t.Errorf("fast blocks: got %08x, want %08x", bits, BigToCompact(expected))
+	}
+
+	// Blocks found on schedule leave the target alone.
+	_, bits = retargetChain(t, params, 3, 30)
+	if bits != params.InitialBits {
+		t.Errorf("blocks on schedule: got %08x, want %08x", bits, params.InitialBits)
+	}
+
+	// Slow blocks make it easier, but never easier than the limit.
+	_, bits = retargetChain(t, params, 3, 1000)
+	if bits != params.PowLimitBits {
+		t.Errorf("slow blocks: got %08x, want %08x", bits, params.PowLimitBits)
+	}
+}
+
+func TestFirstRetargetIgnoresGenesisTimestamp(t *testing.T) {
+	params := DefaultChainParams
+	params.InitialBits = params.PowLimitBits
+	params.PowLimitBits = 0x2100ffff
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	bc := NewBlockChainWithParams(params)
+
+	// The chain starts years after its genesis block, and every block
+	// after that is found on schedule.
+	timestamp := time.Now().Unix() - int64(params.RetargetInterval)*30
+	for i := 1; i < params.RetargetInterval; i++ {
+		prevHash := bc.latestBlock
+		block := NewBlock(prevHash, timestamp, bc.nextBits(prevHash), 0, []Transaction{testCoinbase(key, prevHash)})
+		for !block.isValid() {
+			block.Nonce++
+		}
+		if err := bc.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		timestamp += 30
+	}
+	if bits := bc.nextBits(bc.latestBlock); bits != params.InitialBits {
+		t.Errorf("first retarget on schedule: got %08x, want %08x", bits, params.InitialBits)
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	bc := newTestBlockChain()
+	genesis := bc.latestBlock
+	txs := []Transaction{testCoinbase(key, genesis)}
+
+	mine := func(timestamp int64, bits uint32) Block {
+		block := NewBlock(genesis, timestamp, bits, 0, txs)
+		for !block.isValid() {
+			block.Nonce++
+		}
+		return block
+	}
+
+	if err := bc.addBlock(mine(GenesisTimestamp+1, 0x1f00ffff)); err == nil {
+		t.Error("accepted block with the wrong target")
+	}
+	if err := bc.addBlock(mine(GenesisTimestamp, testChainParams.InitialBits)); err == nil {
+		t.Error("accepted block no later than the median time past")
+	}
+	future := time.Now().Add(MaxFutureBlockTime + time.Minute).Unix()
+	if err := bc.addBlock(mine(future, testChainParams.InitialBits)); err == nil {
+		t.Error("accepted block from the future")
+	}
+	if bc.latestBlock != genesis || len(bc.blocks) != 1 {
+		t.Error("rejected blocks were added to the chain")
+	}
+
+	if err := bc.addBlock(mine(GenesisTimestamp+1, testChainParams.InitialBits)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,253 @@
+package ktcoin
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version numbers of the canonical binary encodings.  Anything that
+// changes the bytes produced for a transaction or block must bump the
+// corresponding version.
+const (
+	TxVersion    = 5
+	BlockVersion = 3
+)
+
+// The canonical encoding of a transaction is:
+//
+//	uint32  version
+//	uint32  number of inputs, followed by each input's 32-byte
+//	        transaction SHA and uint32 output index
+//	uint32  number of senders, followed by each sender's
+//	        PKIX-encoded public key as bytes
+//	uint32  number of outputs, followed by each output's 20-byte
+//	        address and amount as an int64, in order
+//	uint32  number of signatures, followed by each signature as bytes
+//
+// All integers are big-endian, and "bytes" is a uint32 length followed
+// by that many bytes.
+func (t *Transaction) Encode() []byte {
+	var e encoder
+	e.transactionBody(t)
+	e.uint32(uint32(len(t.Signatures)))
+	for _, signature := range t.Signatures {
+		e.bytes(signature)
+	}
+	return e.buf.Bytes()
+}
+
+func (e *encoder) transactionBody(t *Transaction) {
+	e.uint32(TxVersion)
+	e.uint32(uint32(len(t.Inputs)))
+	for _, input := range t.Inputs {
+		e.sha(input.Hash)
+		e.uint32(input.Index)
+	}
+	e.uint32(uint32(len(t.Senders)))
+	for _, sender := range t.Senders {
+		e.publicKey(sender)
+	}
+
+	e.uint32(uint32(len(t.Outputs)))
+	for _, output := range t.Outputs {
+		e.buf.Write(output.Address[:])
+		e.uint64(uint64(int64(output.Amount)))
+	}
+}
+
+// Decodes a transaction from its canonical encoding.  Encodings that
+// aren't canonical (unknown versions, trailing bytes) are rejected, so
+// that decoding and re-encoding a transaction always gives back the
+// same bytes.
+func DecodeTransaction(data []byte) (*Transaction, error) {
+	d := decoder{data: data}
+	version := d.uint32()
+	if d.err == nil && version != TxVersion {
+		return nil, fmt.Errorf("unsupported transaction version %d", version)
+	}
+
+	inputCount := d.count(36)
+	inputs := make([]OutPoint, 0, inputCount)
+	for i := 0; i < inputCount; i++ {
+		inputs = append(inputs, OutPoint{d.sha(), d.uint32()})
+	}
+	senderCount := d.count(4)
+	senders := make([]rsa.PublicKey, 0, senderCount)
+	for i := 0; i < senderCount; i++ {
+		senders = append(senders, d.publicKey())
+	}
+
+	outputCount := d.count(28)
+	outputs := make([]TxOut, 0, outputCount)
+	for i := 0; i < outputCount; i++ {
+		address := d.address()
+		amount := int64(d.uint64())
+		outputs = append(outputs, TxOut{address, int(amount)})
+	}
+	signatureCount := d.count(4)
+	signatures := make([][]byte, 0, signatureCount)
+	for i := 0; i < signatureCount; i++ {
+		signatures = append(signatures, d.bytes())
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.data) != 0 {
+		return nil, errors.New("trailing bytes after transaction")
+	}
+
+	return &Transaction{inputs, senders, outputs, signatures}, nil
+}
+
+// The canonical encoding of a block header is its version, the
+// previous block's hash, the merkle root, the timestamp as a uint64,
+// the compact target and the nonce as a uint64, always 88 bytes.
+func (header *BlockHeader) encode() []byte {
+	var e encoder
+	e.uint32(BlockVersion)
+	e.sha(header.PrevHash)
+	e.sha(header.MerkleRoot)
+	e.uint64(uint64(header.Timestamp))
+	e.uint32(header.Bits)
+	e.uint64(uint64(header.Nonce))
+	return e.buf.Bytes()
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) sha(sha SHA) {
+	e.buf.Write(sha[:])
+}
+
+// Public keys are encoded in PKIX form.  A key that can't be marshaled
+// (such as the zero key) is encoded as empty bytes, which will never
+// verify a signature.
+func (e *encoder) publicKey(key rsa.PublicKey) {
+	if key.N == nil {
+		e.bytes(nil)
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key)
+	if err != nil {
+		e.bytes(nil)
+		return
+	}
+	e.bytes(der)
+}
+
+// A decoder reads the primitives written by an encoder.  The first
+// error is kept and every later read returns a zero value, so callers
+// only need to check for an error once at the end.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+var errShortData = errors.New("unexpected end of encoded data")
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < n {
+		d.err = errShortData
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// Reads an item count, checking it against the remaining data so that
+// a corrupt count can't cause a huge allocation.
+func (d *decoder) count(minItemSize int) int {
+	n := int(d.uint32())
+	if d.err == nil && n > len(d.data)/minItemSize {
+		d.err = errShortData
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if d.err == nil && int(n) > len(d.data) {
+		d.err = errShortData
+		return nil
+	}
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *decoder) sha() SHA {
+	var sha SHA
+	copy(sha[:], d.next(32))
+	return sha
+}
+
+func (d *decoder) address() Address {
+	var address Address
+	copy(address[:], d.next(len(address)))
+	return address
+}
+
+func (d *decoder) publicKey() rsa.PublicKey {
+	der := d.bytes()
+	if d.err != nil || len(der) == 0 {
+		return rsa.PublicKey{}
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		d.err = err
+		return rsa.PublicKey{}
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		d.err = errors.New("invalid key format")
+		return rsa.PublicKey{}
+	}
+	return *rsaKey
+}
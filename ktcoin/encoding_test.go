@@ -0,0 +1,110 @@
+package ktcoin
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+// Fixed keys for the golden vectors.  They're far too small to be
+// secure, but the encoding doesn't care.
+func goldenKey(modulus string) rsa.PublicKey {
+	n, _ := new(big.Int).SetString(modulus, 16)
+	return rsa.PublicKey{N: n, E: 65537}
+}
+
+func goldenTransaction() Transaction {
+	sender := goldenKey("c8a2f1e5d6b7a8c9d0e1f2a3b4c5d6e7")
+	recipient := goldenKey("d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a7")
+	var input1, input2 SHA
+	input1[0] = 1
+	input2[31] = 2
+	outputs := []TxOut{
+		{AddressFromKey(recipient), 7},
+		{AddressFromKey(sender), 18},
+	}
+	return Transaction{[]OutPoint{{input1, 0}, {input2, 3}}, []rsa.PublicKey{sender}, outputs, [][]byte{[]byte("signature")}}
+}
+
+const (
+	goldenTxEncoding = "00000005" + // version
+		"00000002" + // 2 inputs
+		"0100000000000000000000000000000000000000000000000000000000000000" +
+		"00000000" +
+		"0000000000000000000000000000000000000000000000000000000000000002" +
+		"00000003" +
+		"00000001" + // 1 sender
+		"0000002e302c300d06092a864886f70d0101010500031b003018021100c8a2f1" +
+		"e5d6b7a8c9d0e1f2a3b4c5d6e70203010001" +
+		"00000002" + // 2 outputs
+		"12e0e043f79252063106af7b24d4548529e0cd4d" +
+		"0000000000000007" +
+		"62b01ba3f182e3b8087bdb78f19f97a8000541d7" +
+		"0000000000000012" +
+		"00000001" + // 1 signature
+		"000000097369676e6174757265"
+	goldenTxHash    = "4d4e731393cd1a34cf025647966bdb45fabfdf6291d0c3bdcac18d3f0502f0df"
+	goldenBlockHash = "e3f7cae8ebd25869ecb665918de409465b8156838d30b3584fbde48b5f7940fc"
+
+	// The network magic followed by the encoding above without the
+	// signatures.
+	goldenSigningHash = "68d007aa2067935638ee247b30c16f0e50cfad5488bd433a6b21067b3eb855fe"
+)
+
+func TestTransactionEncodingGolden(t *testing.T) {
+	tx := goldenTransaction()
+	if encoded := hex.EncodeToString(tx.Encode()); encoded != goldenTxEncoding {
+		t.Errorf("encoding changed:\n got %s\nwant %s", encoded, goldenTxEncoding)
+	}
+	hash := tx.Hash()
+	if hash.String() != goldenTxHash {
+		t.Errorf("hash changed: got %s, want %s", hash.String(), goldenTxHash)
+	}
+}
+
+func TestBlockHashGolden(t *testing.T) {
+	tx := goldenTransaction()
+	block := NewBlock(tx.Hash(), 1475280000, 0x1f00ffff, 42, []Transaction{tx})
+	hash := block.Hash()
+	if hash.String() != goldenBlockHash {
+		t.Errorf("block hash changed: got %s, want %s", hash.String(), goldenBlockHash)
+	}
+}
+
+func TestTransactionHashCoversAmounts(t *testing.T) {
+	tx := goldenTransaction()
+	first := tx.Hash()
+	tx.Outputs[0].Amount++
+	if tx.Hash() == first {
+		t.Error("changing an amount did not change the hash")
+	}
+}
+
+func TestDecodeTransaction(t *testing.T) {
+	tx := goldenTransaction()
+	encoded := tx.Encode()
+	decoded, err := DecodeTransaction(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Encode(), encoded) {
+		t.Error("decoded transaction does not re-encode to the same bytes")
+	}
+	if decoded.Hash() != tx.Hash() {
+		t.Error("decoded transaction has a different hash")
+	}
+
+	if _, err := DecodeTransaction(encoded[:len(encoded)-1]); err == nil {
+		t.Error("decoded a truncated transaction")
+	}
+	if _, err := DecodeTransaction(append(encoded, 0)); err == nil {
+		t.Error("decoded a transaction with trailing bytes")
+	}
+	badVersion := append([]byte{}, encoded...)
+	badVersion[3] = 99
+	if _, err := DecodeTransaction(badVersion); err == nil {
+		t.Error("decoded a transaction with an unknown version")
+	}
+}
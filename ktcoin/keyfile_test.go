@@ -0,0 +1,122 @@
+package ktcoin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testPassphrase(passphrase string) PassphraseFunc {
+	return func() ([]byte, error) {
+		return []byte(passphrase), nil
+	}
+}
+
+func TestKeyEncryption(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	encrypted, err := newKeyCrypter(testPassphrase("correct horse")).encrypt(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, x509.MarshalPKCS1PrivateKey(key)) {
+		t.Fatal("key was stored in the clear")
+	}
+
+	decrypted, err := newKeyCrypter(testPassphrase("correct horse")).decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.N.Cmp(key.N) != 0 || decrypted.D.Cmp(key.D) != 0 {
+		t.Error("decrypted a different key")
+	}
+	if _, err := newKeyCrypter(testPassphrase("battery staple")).decrypt(encrypted); !errors.Is(err, ErrWrongPassphrase) {
+		t.Error("expected the wrong passphrase to fail, got", err)
+	}
+	if _, err := newKeyCrypter(nil).decrypt(encrypted); err == nil {
+		t.Error("decrypted a key without a passphrase")
+	}
+
+	// The headers are authenticated along with the key.
+	block, _ := pem.Decode(encrypted)
+	block.Headers["Iterations"] = "1"
+	if _, err := newKeyCrypter(testPassphrase("correct horse")).decrypt(pem.EncodeToMemory(block)); err == nil {
+		t.Error("decrypted a key with altered headers")
+	}
+
+	// An iteration count that would take too long to derive a key
+	// with is refused before trying.
+	block.Headers["Iterations"] = strconv.Itoa(MaxKeyIterations + 1)
+	if _, err := newKeyCrypter(testPassphrase("correct horse")).decrypt(pem.EncodeToMemory(block)); err == nil || !strings.Contains(err.Error(), "iteration count") {
+		t.Error("expected the iteration count to be refused, got", err)
+	}
+}
+
+func TestGenerateAndLoadKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "id_rsa")
+	if err := GenerateKey(keyFile, testPassphrase("secret")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file has mode %v, want 0600", info.Mode().Perm())
+	}
+	if err := GenerateKey(keyFile, testPassphrase("secret")); err == nil {
+		t.Error("overwrote an existing key file")
+	}
+
+	key, err := LoadKey(keyFile, testPassphrase("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := LoadPublicKey(keyFile + ".pub")
+	if err != nil || pub.N.Cmp(key.N) != 0 {
+		t.Error("public key file does not match the private key:", err)
+	}
+	if _, err := LoadKey(keyFile, testPassphrase("wrong")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Error("expected the wrong passphrase to fail, got", err)
+	}
+}
+
+func TestEncryptKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "id_rsa")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	plain := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyFile, plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plaintext keys still load, without asking for a passphrase.
+	if _, err := LoadKey(keyFile, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EncryptKeyFile(keyFile, testPassphrase("secret")); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(keyFile)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file has mode %v, want 0600", info.Mode().Perm())
+	}
+	if _, err := LoadKey(keyFile, nil); err == nil {
+		t.Error("loaded an encrypted key without a passphrase")
+	}
+	loaded, err := LoadKey(keyFile, testPassphrase("secret"))
+	if err != nil || loaded.N.Cmp(key.N) != 0 {
+		t.Error("encrypted key file does not hold the original key:", err)
+	}
+	if err := EncryptKeyFile(keyFile, testPassphrase("secret")); err == nil {
+		t.Error("encrypted a key file twice")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 )
 
 type SHA [32]byte
@@ -17,21 +18,35 @@ func (sha *SHA) String() string {
 	return fmt.Sprintf("%x", *sha)
 }
 
-func GenerateKey(keyname string) error {
+// Generates a new private key and writes it to keyname, encrypted
+// under the passphrase, with its public key in keyname.pub.  An
+// existing key file is never overwritten.
+func GenerateKey(keyname string, passphrase PassphraseFunc) error {
 	fmt.Println("Generating RSA private key...")
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return err
 	}
-	privKeyBytes := x509.MarshalPKCS1PrivateKey(key)
-	privPem := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: privKeyBytes,
-		})
+	return writeKeyFiles(key, keyname, newKeyCrypter(passphrase))
+}
+
+// Writes a private key to keyname, encrypted and readable only by its
+// owner, and the public key to keyname.pub.
+func writeKeyFiles(key *rsa.PrivateKey, keyname string, c *keyCrypter) error {
+	encrypted, err := c.encrypt(key)
+	if err != nil {
+		return err
+	}
+	err = createFile(keyname, encrypted, 0600)
+	if err != nil {
+		return err
+	}
+	return WritePublicKey(key.PublicKey, keyname+".pub")
+}
 
-	publicKey := key.PublicKey
-	pubKeyBytes, err := x509.MarshalPKIXPublicKey(&publicKey)
+// Writes a public key to a new file, in the form LoadPublicKey reads.
+func WritePublicKey(key rsa.PublicKey, path string) error {
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(&key)
 	if err != nil {
 		return err
 	}
@@ -42,28 +57,34 @@ func GenerateKey(keyname string) error {
 			Bytes: pubKeyBytes,
 		},
 	)
-	ioutil.WriteFile(keyname, privPem, 0644)
-	ioutil.WriteFile(keyname+".pub", pubPem, 0644)
-	return nil
+	return createFile(path, pubPem, 0644)
 }
 
-func LoadKey(keyname string) (*rsa.PrivateKey, error) {
-	privKeyPem, err := ioutil.ReadFile(keyname)
+// Writes data to a new file, failing if the file already exists.
+func createFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	privBlock, _ := pem.Decode([]byte(privKeyPem))
-	if privBlock == nil {
-		return nil, errors.New("failed to parse private key PEM block")
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
+	return err
+}
 
-	privKey, err := x509.ParsePKCS1PrivateKey(privBlock.Bytes)
+// Loads a private key file.  If the key is encrypted, the passphrase
+// is asked for.
+func LoadKey(keyname string, passphrase PassphraseFunc) (*rsa.PrivateKey, error) {
+	privKeyPem, err := ioutil.ReadFile(keyname)
 	if err != nil {
 		return nil, err
 	}
-
-	return privKey, nil
+	key, err := newKeyCrypter(passphrase).decrypt(privKeyPem)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyname, err)
+	}
+	return key, nil
 }
 
 func LoadPublicKey(keyname string) (*rsa.PublicKey, error) {
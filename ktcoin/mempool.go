@@ -0,0 +1,212 @@
+package ktcoin
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// The most bytes of transactions a node keeps waiting to be mined.
+// When the pool is full, the transactions paying the lowest fee rates
+// make room for better ones.
+const MaxMempoolSize = 32 << 20
+
+// How long a transaction may wait to be mined before it's dropped.
+const MempoolExpiry = 24 * time.Hour
+
+// How often the mempool is checked for expired transactions.
+const MempoolExpiryInterval = 10 * time.Minute
+
+var errMempoolFull = errors.New("mempool is full and the transaction's fee rate is too low")
+
+// A transaction waiting to be mined, with the fee it pays, the size of
+// its encoding and when it arrived.
+type pendingTransaction struct {
+	tx    Transaction
+	hash  SHA
+	fee   int
+	size  int
+	added time.Time
+}
+
+// Returns true if p pays a higher fee per byte than other.
+func (p *pendingTransaction) paysMoreThan(other *pendingTransaction) bool {
+	return p.fee*other.size > other.fee*p.size
+}
+
+// The Mempool holds the transactions a node has accepted but that
+// aren't yet in a block on the main chain.  Transactions are kept in
+// order of fee rate, highest first, and are indexed both by hash and
+// by the inputs they spend so that double spends can be turned away.
+// It's only used from the server's request loop, so it isn't locked.
+type Mempool struct {
+	ordered []*pendingTransaction
+	txs     map[SHA]*pendingTransaction
+	spends  map[OutPoint]SHA
+	size    int
+	maxSize int
+	expiry  time.Duration
+}
+
+func NewMempool(maxSize int, expiry time.Duration) *Mempool {
+	return &Mempool{
+		ordered: []*pendingTransaction{},
+		txs:     make(map[SHA]*pendingTransaction),
+		spends:  make(map[OutPoint]SHA),
+		maxSize: maxSize,
+		expiry:  expiry,
+	}
+}
+
+// The number of transactions in the pool.
+func (mp *Mempool) Len() int {
+	return len(mp.ordered)
+}
+
+// The total size in bytes of the transactions in the pool.
+func (mp *Mempool) Size() int {
+	return mp.size
+}
+
+func (mp *Mempool) Has(hash SHA) bool {
+	_, ok := mp.txs[hash]
+	return ok
+}
+
+// Returns the pending transaction with the given hash, or nil.
+func (mp *Mempool) Get(hash SHA) *Transaction {
+	pending, ok := mp.txs[hash]
+	if !ok {
+		return nil
+	}
+	return &pending.tx
+}
+
+// Returns true if a pending transaction spends the output.
+func (mp *Mempool) Spends(outPoint OutPoint) bool {
+	_, ok := mp.spends[outPoint]
+	return ok
+}
+
+// Rejects a transaction that's already pending, or that spends an
+// input some pending transaction already spends.
+func (mp *Mempool) CheckConflicts(tx *Transaction) error {
+	hash := tx.Hash()
+	if mp.Has(hash) {
+		return errors.New("transaction is already pending")
+	}
+	for _, input := range tx.Inputs {
+		other, ok := mp.spends[input]
+		if ok {
+			return &ConflictError{hash, other, input}
+		}
+	}
+	return nil
+}
+
+// Adds a verified transaction paying the given fee.  Transactions
+// paying the same rate stay in the order they arrived.  If the pool
+// grows past its size limit, the transactions paying the lowest rates
+// are evicted; if that includes the new transaction, it's an error.
+func (mp *Mempool) Add(tx Transaction, fee int, now time.Time) error {
+	err := mp.CheckConflicts(&tx)
+	if err != nil {
+		return err
+	}
+	pending := &pendingTransaction{tx, tx.Hash(), fee, len(tx.Encode()), now}
+	mp.insert(pending)
+
+	for mp.size > mp.maxSize {
+		worst := mp.ordered[len(mp.ordered)-1]
+		mp.Remove(worst.hash)
+		if worst == pending {
+			return errMempoolFull
+		}
+	}
+	return nil
+}
+
+// Puts a transaction in its place in the fee rate order and indexes
+// it.
+func (mp *Mempool) insert(pending *pendingTransaction) {
+	i := sort.Search(len(mp.ordered), func(i int) bool {
+		return pending.paysMoreThan(mp.ordered[i])
+	})
+	mp.ordered = append(mp.ordered, nil)
+	copy(mp.ordered[i+1:], mp.ordered[i:])
+	mp.ordered[i] = pending
+
+	mp.txs[pending.hash] = pending
+	for _, input := range pending.tx.Inputs {
+		mp.spends[input] = pending.hash
+	}
+	mp.size += pending.size
+}
+
+// Removes a transaction from the pool, returning false if it wasn't
+// there.
+func (mp *Mempool) Remove(hash SHA) bool {
+	pending, ok := mp.txs[hash]
+	if !ok {
+		return false
+	}
+	for i, p := range mp.ordered {
+		if p == pending {
+			mp.ordered = append(mp.ordered[:i], mp.ordered[i+1:]...)
+			break
+		}
+	}
+	delete(mp.txs, hash)
+	for _, input := range pending.tx.Inputs {
+		delete(mp.spends, input)
+	}
+	mp.size -= pending.size
+	return true
+}
+
+// Returns up to n of the pending transactions paying the highest fee
+// rates, best first.
+func (mp *Mempool) Best(n int) []pendingTransaction {
+	if n > len(mp.ordered) {
+		n = len(mp.ordered)
+	}
+	best := make([]pendingTransaction, n)
+	for i := range best {
+		best[i] = *mp.ordered[i]
+	}
+	return best
+}
+
+// Returns every pending transaction, best first.
+func (mp *Mempool) Entries() []pendingTransaction {
+	return mp.Best(len(mp.ordered))
+}
+
+// Drops transactions that have waited longer than the expiry time,
+// returning how many were dropped.
+func (mp *Mempool) Expire(now time.Time) int {
+	expired := make([]SHA, 0)
+	for _, pending := range mp.ordered {
+		if now.Sub(pending.added) > mp.expiry {
+			expired = append(expired, pending.hash)
+		}
+	}
+	for _, hash := range expired {
+		mp.Remove(hash)
+	}
+	return len(expired)
+}
+
+// Removes the transactions a newly connected block confirms, along with
+// any that spend an input the block has now spent.
+func (mp *Mempool) BlockConnected(block *Block) {
+	for i := range block.Transactions {
+		tx := &block.Transactions[i]
+		mp.Remove(tx.Hash())
+		for _, input := range tx.Inputs {
+			if other, ok := mp.spends[input]; ok {
+				mp.Remove(other)
+			}
+		}
+	}
+}
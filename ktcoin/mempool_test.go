@@ -0,0 +1,187 @@
+package ktcoin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+)
+
+// Returns a transaction that spends a made-up input, so that it can be
+// added to a mempool without conflicting with any other.
+func fakeTransaction(id byte) Transaction {
+	return Transaction{Inputs: []OutPoint{{SHA{id}, 0}}, Signatures: [][]byte{{id}}}
+}
+
+func TestMempoolOrderedByFeeRate(t *testing.T) {
+	mp := NewMempool(MaxMempoolSize, MempoolExpiry)
+	pending := []pendingTransaction{
+		{Transaction{Signatures: [][]byte{[]byte("a")}}, SHA{1}, 10, 1000, time.Time{}},
+		{Transaction{Signatures: [][]byte{[]byte("b")}}, SHA{2}, 10, 200, time.Time{}},
+		{Transaction{Signatures: [][]byte{[]byte("c")}}, SHA{3}, 0, 300, time.Time{}},
+		{Transaction{Signatures: [][]byte{[]byte("d")}}, SHA{4}, 50, 1000, time.Time{}},
+		{Transaction{Signatures: [][]byte{[]byte("e")}}, SHA{5}, 1, 100, time.Time{}},
+	}
+	for i := range pending {
+		mp.insert(&pending[i])
+	}
+
+	// Fee rates: b = 0.05, d = 0.05, e = 0.01, a = 0.01, c = 0.
+	// Ties are broken by arrival order.
+	expected := "bdaec"
+	order := ""
+	for _, p := range mp.Entries() {
+		order += string(p.tx.Signatures[0])
+	}
+	if order != expected {
+		t.Errorf("got order %s, want %s", order, expected)
+	}
+	if mp.Size() != 2600 {
+		t.Errorf("got size %d, want 2600", mp.Size())
+	}
+}
+
+func TestMempoolEviction(t *testing.T) {
+	tx := fakeTransaction(0)
+	size := len(tx.Encode())
+	mp := NewMempool(3*size, MempoolExpiry)
+	now := time.Now()
+	for i, fee := range []int{10, 20, 30} {
+		if err := mp.Add(fakeTransaction(byte(i)), fee, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A transaction paying less than everything in a full pool is
+	// turned away; one paying more pushes out the cheapest.
+	if err := mp.Add(fakeTransaction(3), 5, now); err != errMempoolFull {
+		t.Error("expected a full mempool, got", err)
+	}
+	if err := mp.Add(fakeTransaction(4), 40, now); err != nil {
+		t.Fatal(err)
+	}
+	cheapest := fakeTransaction(0)
+	if mp.Has(cheapest.Hash()) {
+		t.Error("cheapest transaction was not evicted")
+	}
+	if _, ok := mp.spends[cheapest.Inputs[0]]; ok {
+		t.Error("evicted transaction's input is still pending")
+	}
+	if mp.Len() != 3 || mp.Size() != 3*size {
+		t.Errorf("got %d transactions of %d bytes, want 3 of %d", mp.Len(), mp.Size(), 3*size)
+	}
+	best := mp.Best(1)
+	if len(best) != 1 || best[0].fee != 40 {
+		t.Error("best transaction is not the one paying the most")
+	}
+}
+
+func TestMempoolExpiry(t *testing.T) {
+	mp := NewMempool(MaxMempoolSize, time.Hour)
+	start := time.Now()
+	old, recent := fakeTransaction(1), fakeTransaction(2)
+	mp.Add(old, 0, start)
+	mp.Add(recent, 0, start.Add(30*time.Minute))
+
+	if expired := mp.Expire(start.Add(time.Hour)); expired != 0 {
+		t.Errorf("expired %d transactions too early", expired)
+	}
+	if expired := mp.Expire(start.Add(61 * time.Minute)); expired != 1 {
+		t.Errorf("expired %d transactions, want 1", expired)
+	}
+	if mp.Has(old.Hash()) || !mp.Has(recent.Hash()) {
+		t.Error("expired the wrong transaction")
+	}
+}
+
+func TestMempoolFollowsChain(t *testing.T) {
+	bc := newTestBlockChain()
+	genesis := bc.latestBlock
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := newTestServer(t, &bc)
+
+	addBlock := func(block Block) {
+		previousTip := bc.latestBlock
+		NewBlockNotice{block, nil}.rpcHandle(server)
+		if bc.latestBlock == previousTip {
+			t.Fatal("block did not become the new tip")
+		}
+	}
+	submit := func(tx *Transaction) {
+		cb := make(chan error, 1)
+		TransactionRequest{*tx, cb}.rpcHandle(server)
+		if err := <-cb; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a1 := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(alice, genesis)})
+	addBlock(a1)
+	a1Sha := a1.Hash()
+	toBob, _ := NewTransaction(outputsOf(&a1.Transactions[0]), alice, []Payment{{AddressFromKey(bob.PublicKey), 25}}, 0)
+	toAlice, _ := NewTransaction(outputsOf(&a1.Transactions[0]), alice, []Payment{{AddressFromKey(alice.PublicKey), 25}}, 0)
+	submit(toBob)
+
+	// A block from a peer confirming the transaction takes it out of
+	// the pool.
+	a2 := mineTestBlock(&bc, a1Sha, []Transaction{testCoinbase(alice, a1Sha), *toBob})
+	addBlock(a2)
+	if server.mempool.Len() != 0 {
+		t.Fatal("confirmed transaction is still pending")
+	}
+
+	// When a heavier branch without it replaces that block, it goes
+	// back in.
+	b2 := mineTestBlock(&bc, a1Sha, []Transaction{testCoinbase(bob, a1Sha)})
+	b2Sha := b2.Hash()
+	b3 := mineTestBlock(&bc, b2Sha, []Transaction{testCoinbase(bob, b2Sha)})
+	b3Sha := b3.Hash()
+	NewBlockNotice{b2, nil}.rpcHandle(server)
+	addBlock(b3)
+	if !server.mempool.Has(toBob.Hash()) {
+		t.Fatal("transaction from the disconnected block was not restored")
+	}
+
+	// A block spending the same input another way evicts it.
+	b4 := mineTestBlock(&bc, b3Sha, []Transaction{testCoinbase(bob, b3Sha), *toAlice})
+	addBlock(b4)
+	if server.mempool.Len() != 0 || len(server.mempool.spends) != 0 {
+		t.Error("conflicting transaction is still pending")
+	}
+}
+
+func TestMempoolDropsTransactionsInvalidAfterReorg(t *testing.T) {
+	bc := newTestBlockChain()
+	genesis := bc.latestBlock
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := newTestServer(t, &bc)
+
+	a1 := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(alice, genesis)})
+	NewBlockNotice{a1, nil}.rpcHandle(server)
+	toBob, _ := NewTransaction(outputsOf(&a1.Transactions[0]), alice, []Payment{{AddressFromKey(bob.PublicKey), 25}}, 0)
+	cb := make(chan error, 1)
+	TransactionRequest{*toBob, cb}.rpcHandle(server)
+	if err := <-cb; err != nil {
+		t.Fatal(err)
+	}
+	server.mempoolChanged = false
+
+	// A heavier branch without a1 takes away the coinbase the pending
+	// transaction spends.
+	b1 := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(bob, genesis)})
+	b1Sha := b1.Hash()
+	b2 := mineTestBlock(&bc, b1Sha, []Transaction{testCoinbase(bob, b1Sha)})
+	NewBlockNotice{b1, nil}.rpcHandle(server)
+	NewBlockNotice{b2, nil}.rpcHandle(server)
+	if bc.latestBlock != b2.Hash() {
+		t.Fatal("the heavier branch did not become the main chain")
+	}
+	if server.mempool.Has(toBob.Hash()) || len(server.mempool.spends) != 0 {
+		t.Error("transaction spending a disconnected coinbase is still pending")
+	}
+	if !server.mempoolChanged {
+		t.Error("the miner was not told the pending transactions changed")
+	}
+}
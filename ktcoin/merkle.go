@@ -0,0 +1,115 @@
+package ktcoin
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// The merkle root of a list of transactions.  Transaction hashes are
+// paired up and hashed together, level by level, until one hash is
+// left; a level with an odd number of hashes pairs its last hash with
+// itself.  A block with no transactions has the zero hash as its root.
+func merkleRoot(transactions []Transaction) SHA {
+	root, _ := merkleRootMutated(transactions)
+	return root
+}
+
+// Like merkleRoot, but also reports whether any level of the tree pairs
+// a hash with an identical one.  Since an odd level pairs its last hash
+// with itself, a list of transactions ending in [..., c] has the same
+// root as one ending in [..., c, c], and so would give a block with the
+// same hash.  No valid block includes a transaction twice, so a list
+// like that is always a malformed copy of another block.
+func merkleRootMutated(transactions []Transaction) (SHA, bool) {
+	if len(transactions) == 0 {
+		return SHA{}, false
+	}
+	level := make([]SHA, len(transactions))
+	for i := range transactions {
+		level[i] = transactions[i].Hash()
+	}
+	mutated := false
+	for len(level) > 1 {
+		for i := 0; i+1 < len(level); i += 2 {
+			if level[i] == level[i+1] {
+				mutated = true
+			}
+		}
+		level = nextMerkleLevel(level)
+	}
+	return level[0], mutated
+}
+
+func nextMerkleLevel(level []SHA) []SHA {
+	next := make([]SHA, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		next = append(next, hashMerklePair(level[i], right))
+	}
+	return next
+}
+
+func hashMerklePair(left, right SHA) SHA {
+	var pair [64]byte
+	copy(pair[:32], left[:])
+	copy(pair[32:], right[:])
+	return sha256.Sum256(pair[:])
+}
+
+// A MerkleProof shows that a transaction is included in a block
+// without needing the block's other transactions.  Index is the
+// transaction's position in the block and Siblings are the hashes it
+// is paired with at each level of the tree, from the bottom up.
+type MerkleProof struct {
+	Index    int
+	Siblings []SHA
+}
+
+// Builds a proof that the transaction with the given hash is included
+// in the block.
+func (block *Block) MerkleProof(txHash SHA) (*MerkleProof, error) {
+	level := make([]SHA, len(block.Transactions))
+	index := -1
+	for i := range block.Transactions {
+		level[i] = block.Transactions[i].Hash()
+		if level[i] == txHash && index < 0 {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, errors.New("transaction is not in block")
+	}
+
+	proof := MerkleProof{index, nil}
+	for position := index; len(level) > 1; position /= 2 {
+		sibling := position ^ 1
+		if sibling >= len(level) {
+			sibling = position
+		}
+		proof.Siblings = append(proof.Siblings, level[sibling])
+		level = nextMerkleLevel(level)
+	}
+	return &proof, nil
+}
+
+// Checks that the proof links a transaction hash to a merkle root, such
+// as the one in a block header.
+func (proof *MerkleProof) Verify(txHash SHA, root SHA) bool {
+	if proof.Index < 0 || proof.Index >= 1<<uint(len(proof.Siblings)) {
+		return false
+	}
+	hash := txHash
+	position := proof.Index
+	for _, sibling := range proof.Siblings {
+		if position%2 == 0 {
+			hash = hashMerklePair(hash, sibling)
+		} else {
+			hash = hashMerklePair(sibling, hash)
+		}
+		position /= 2
+	}
+	return hash == root
+}
@@ -0,0 +1,158 @@
+package ktcoin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func merkleTestTransactions(n int) []Transaction {
+	transactions := make([]Transaction, n)
+	for i := range transactions {
+		transactions[i] = Transaction{Signatures: [][]byte{{byte(i)}}}
+	}
+	return transactions
+}
+
+func TestMerkleRoot(t *testing.T) {
+	if merkleRoot(nil) != (SHA{}) {
+		t.Error("empty block should have the zero merkle root")
+	}
+
+	txs := merkleTestTransactions(3)
+	if merkleRoot(txs[:1]) != txs[0].Hash() {
+		t.Error("root of one transaction should be its hash")
+	}
+
+	// The odd transaction out is paired with itself.
+	a, b, c := txs[0].Hash(), txs[1].Hash(), txs[2].Hash()
+	expected := hashMerklePair(hashMerklePair(a, b), hashMerklePair(c, c))
+	if merkleRoot(txs) != expected {
+		t.Error("merkle root of three transactions is wrong")
+	}
+
+	swapped := []Transaction{txs[1], txs[0], txs[2]}
+	if merkleRoot(swapped) == merkleRoot(txs) {
+		t.Error("merkle root does not cover transaction order")
+	}
+
+	// Repeating the odd transaction out gives the same root, which is
+	// why the repeat is reported.
+	repeated := append(append([]Transaction{}, txs...), txs[2])
+	root, mutated := merkleRootMutated(txs)
+	repeatedRoot, repeatedMutated := merkleRootMutated(repeated)
+	if mutated || !repeatedMutated || root != repeatedRoot {
+		t.Error("did not report the repeated transaction")
+	}
+	// So is a repeat further up the tree.
+	six := merkleTestTransactions(6)
+	root, _ = merkleRootMutated(six)
+	repeatedRoot, repeatedMutated = merkleRootMutated(append(six[:6:6], six[4], six[5]))
+	if !repeatedMutated || root != repeatedRoot {
+		t.Error("did not report a repeated pair of transactions")
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		block := NewBlock(SHA{}, 0, 0, 0, merkleTestTransactions(n))
+		for i := range block.Transactions {
+			txHash := block.Transactions[i].Hash()
+			proof, err := block.MerkleProof(txHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proof.Index != i {
+				t.Errorf("%d transactions: proof for %d has index %d", n, i, proof.Index)
+			}
+			if !proof.Verify(txHash, block.MerkleRoot) {
+				t.Errorf("%d transactions: proof for %d does not verify", n, i)
+			}
+
+			var other SHA
+			other[0] = 1
+			if proof.Verify(other, block.MerkleRoot) {
+				t.Errorf("%d transactions: proof verified the wrong transaction", n)
+			}
+			if i^1 < n {
+				moved := MerkleProof{i ^ 1, proof.Siblings}
+				if moved.Verify(txHash, block.MerkleRoot) {
+					t.Errorf("%d transactions: proof verified at the wrong index", n)
+				}
+			}
+		}
+	}
+
+	block := NewBlock(SHA{}, 0, 0, 0, merkleTestTransactions(2))
+	if _, err := block.MerkleProof(SHA{}); err == nil {
+		t.Error("built a proof for a transaction not in the block")
+	}
+}
+
+func TestBlockMerkleRootChecked(t *testing.T) {
+	bc := newTestBlockChain()
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	genesis := bc.latestBlock
+
+	block := mineTestBlock(&bc, genesis, []Transaction{testCoinbase(key, genesis)})
+	block.Transactions = append(block.Transactions, merkleTestTransactions(1)...)
+	if err := bc.addBlock(block); err == nil {
+		t.Error("accepted a block whose transactions don't match its merkle root")
+	}
+	if len(bc.blocks) != 1 {
+		t.Error("block with a bad merkle root was kept")
+	}
+}
+
+func TestMutatedBlockRejected(t *testing.T) {
+	dir := t.TempDir()
+	bc, err := OpenBlockChain(dir, testChainParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := rsa.GenerateKey(rand.Reader, 1024)
+	bob, _ := rsa.GenerateKey(rand.Reader, 1024)
+	coinbases := make([]Transaction, 0)
+	for i := 0; i < 2; i++ {
+		coinbase := testCoinbase(alice, bc.latestBlock)
+		if err := bc.addNextBlock(10000, 0, []Transaction{coinbase}); err != nil {
+			t.Fatal(err)
+		}
+		coinbases = append(coinbases, coinbase)
+	}
+
+	prevHash := bc.latestBlock
+	txs := []Transaction{testCoinbase(bob, prevHash)}
+	for i := range coinbases {
+		spend, _ := NewTransaction(outputsOf(&coinbases[i]), alice, []Payment{{AddressFromKey(bob.PublicKey), 25}}, 0)
+		txs = append(txs, *spend)
+	}
+	valid := mineTestBlock(bc, prevHash, txs)
+	mutated := valid
+	mutated.Transactions = append(append([]Transaction{}, txs...), txs[2])
+	if mutated.Hash() != valid.Hash() {
+		t.Fatal("expected the mutated block to share the valid block's hash")
+	}
+
+	// The malformed copy arriving first doesn't stop the real block
+	// being accepted and stored.
+	if err := bc.addBlock(mutated); err == nil {
+		t.Error("accepted a block with a repeated transaction")
+	}
+	if err := bc.addBlock(valid); err != nil {
+		t.Fatal(err)
+	}
+	if bc.latestBlock != valid.Hash() {
+		t.Fatal("valid block did not become the tip")
+	}
+	bc.store.Close()
+
+	reopened, err := OpenBlockChain(dir, testChainParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.store.Close()
+	if reopened.latestBlock != valid.Hash() || len(reopened.blocks[valid.Hash()].Transactions) != 3 {
+		t.Error("valid block was not stored")
+	}
+}
@@ -0,0 +1,87 @@
+package ktcoin
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// How many nonces a worker tries between checks for cancellation.
+const minerCheckInterval = 1000
+
+// A Miner searches for a nonce that satisfies a block template's proof
+// of work using a pool of worker goroutines.  Each worker tries a
+// different slice of the nonce space.  Starting on a new template
+// cancels the search on the old one, so a miner never keeps hashing a
+// block that can no longer extend the chain.
+type Miner struct {
+	workers int
+	found   chan Block
+	stop    chan struct{}
+	running sync.WaitGroup
+	hashes  uint64
+}
+
+func NewMiner(workers int) *Miner {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Miner{workers: workers, found: make(chan Block)}
+}
+
+// Starts searching for a valid nonce for the template, abandoning any
+// template the miner was working on before.  Solved blocks are
+// delivered on Found.
+func (m *Miner) Mine(template Block) {
+	m.Stop()
+	m.stop = make(chan struct{})
+	for i := 0; i < m.workers; i++ {
+		m.running.Add(1)
+		go m.work(template, template.Nonce+i, m.workers, m.stop)
+	}
+}
+
+// Cancels the current search and waits for every worker to give up.
+func (m *Miner) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	m.running.Wait()
+	m.stop = nil
+}
+
+// The channel on which solved blocks are delivered.
+func (m *Miner) Found() <-chan Block {
+	return m.found
+}
+
+// Returns the number of hashes tried since the last call.
+func (m *Miner) TakeHashes() uint64 {
+	return atomic.SwapUint64(&m.hashes, 0)
+}
+
+func (m *Miner) work(block Block, nonce, step int, stop chan struct{}) {
+	defer m.running.Done()
+	target := CompactToBig(block.Bits)
+	block.Nonce = nonce
+	for {
+		for i := 0; i < minerCheckInterval; i++ {
+			if hashMeetsTarget(block.Hash(), target) {
+				atomic.AddUint64(&m.hashes, uint64(i+1))
+				select {
+				case m.found <- block:
+				case <-stop:
+				}
+				return
+			}
+			block.Nonce += step
+		}
+		atomic.AddUint64(&m.hashes, minerCheckInterval)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
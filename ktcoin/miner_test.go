@@ -0,0 +1,73 @@
+package ktcoin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMinerFindsBlock(t *testing.T) {
+	bc := newTestBlockChain()
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	template := bc.newBlockTemplate(0, []Transaction{testCoinbase(key, bc.latestBlock)})
+
+	miner := NewMiner(4)
+	miner.Mine(template)
+	defer miner.Stop()
+
+	select {
+	case block := <-miner.Found():
+		if block.MerkleRoot != template.MerkleRoot || block.PrevHash != template.PrevHash {
+			t.Error("miner changed the block template")
+		}
+		if err := bc.addBlock(block); err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("miner did not find a block")
+	}
+	if miner.TakeHashes() == 0 {
+		t.Error("miner did not count its hashes")
+	}
+}
+
+func TestMinerStop(t *testing.T) {
+	bc := newTestBlockChain()
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	template := bc.newBlockTemplate(0, []Transaction{testCoinbase(key, bc.latestBlock)})
+	template.Bits = 0x03000001 // practically impossible
+
+	miner := NewMiner(2)
+	miner.Mine(template)
+	abandoned := miner.stop
+	for miner.TakeHashes() == 0 {
+		runtime.Gosched()
+	}
+
+	// Starting on a new template abandons the old one.
+	miner.Mine(template)
+	select {
+	case <-abandoned:
+	default:
+		t.Error("search on the old template was not cancelled")
+	}
+
+	// Stop only returns once every worker has given up, so nothing is
+	// hashed after it.
+	stopped := make(chan struct{})
+	go func() {
+		miner.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("miner did not stop")
+	}
+	miner.TakeHashes()
+	if hashes := miner.TakeHashes(); hashes != 0 {
+		t.Errorf("stopped miner kept hashing: %d hashes", hashes)
+	}
+}
@@ -0,0 +1,466 @@
+package ktcoin
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The version of the peer-to-peer protocol this node speaks.  It must
+// be bumped whenever the RPCs or the encoding of blocks and
+// transactions change in a way older nodes can't understand.
+const ProtocolVersion = 5
+
+// How often a node tries to reach its peers and learn new addresses
+// from them.
+const PeerRefreshInterval = time.Minute
+
+// The most addresses a node shares with a peer at once.
+const MaxSharedAddresses = 100
+
+// The oldest protocol version we'll talk to.
+const MinProtocolVersion = 5
+
+const UserAgent = "ktcoin:0.1"
+
+// Exchanged by the Hello RPC before a node talks to a peer, so that
+// nodes running incompatible software or on different networks find
+// out straight away instead of failing in confusing ways later.
+// ListenAddress is where the sender accepts connections from peers,
+// which lets a node that was dialed connect back.
+type VersionMessage struct {
+	ProtocolVersion uint32
+	NetworkMagic    uint32
+	GenesisHash     SHA
+	BestHeight      int
+	UserAgent       string
+	Nonce           uint64
+	ListenAddress   string
+}
+
+// What we know about a peer from the last time we connected to it.
+type PeerInfo struct {
+	Address  string
+	Version  VersionMessage
+	Status   string
+	LastSeen time.Time
+}
+
+type VersionRequest struct {
+	callbackChannel chan VersionMessage
+}
+
+func (req VersionRequest) rpcHandle(server *BlockChainServer) {
+	req.callbackChannel <- server.versionMessage()
+}
+
+type PeerStatusNotice struct {
+	info PeerInfo
+}
+
+func (notice PeerStatusNotice) rpcHandle(server *BlockChainServer) {
+	server.peers[notice.info.Address] = notice.info
+}
+
+type RemovePeerNotice struct {
+	address string
+}
+
+func (notice RemovePeerNotice) rpcHandle(server *BlockChainServer) {
+	delete(server.peers, notice.address)
+}
+
+type PeerDisconnectedNotice struct {
+	address string
+	err     error
+}
+
+func (notice PeerDisconnectedNotice) rpcHandle(server *BlockChainServer) {
+	if info, ok := server.peers[notice.address]; ok {
+		info.Status = "disconnected: " + notice.err.Error()
+		server.peers[notice.address] = info
+	}
+}
+
+type PeersRequest struct {
+	callbackChannel chan []PeerInfo
+}
+
+func (req PeersRequest) rpcHandle(server *BlockChainServer) {
+	req.callbackChannel <- sortedPeers(server.peers)
+}
+
+func sortedPeers(peerMap map[string]PeerInfo) []PeerInfo {
+	peers := make([]PeerInfo, 0, len(peerMap))
+	for _, info := range peerMap {
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers
+}
+
+func (s *BlockChainServer) versionMessage() VersionMessage {
+	_, height := s.blockchain.Tip()
+	return VersionMessage{
+		ProtocolVersion,
+		NetworkMagic,
+		s.blockchain.mainChain[0],
+		height,
+		UserAgent,
+		s.nonce,
+		s.listenAddress,
+	}
+}
+
+// Returns an error describing why we can't talk to a peer that sent
+// the given version message.
+func checkVersion(ours, theirs VersionMessage) error {
+	if theirs.NetworkMagic != ours.NetworkMagic {
+		return fmt.Errorf("peer is on network %08x, not %08x", theirs.NetworkMagic, ours.NetworkMagic)
+	}
+	if theirs.GenesisHash != ours.GenesisHash {
+		return fmt.Errorf("peer has genesis block %x, not %x", theirs.GenesisHash, ours.GenesisHash)
+	}
+	if ours.Nonce != 0 && theirs.Nonce == ours.Nonce {
+		return errSelfConnection
+	}
+	if theirs.ProtocolVersion < MinProtocolVersion {
+		return fmt.Errorf("peer speaks protocol version %d, older than %d", theirs.ProtocolVersion, MinProtocolVersion)
+	}
+	return nil
+}
+
+var errNoHandshake = errors.New("peer did not send a version message")
+
+// Returned when a node dials its own address, which it can learn from
+// its peers like any other.  Each node picks a random nonce when it
+// starts, so it recognizes its own version message.
+var errSelfConnection = errors.New("connected to ourselves")
+
+// Connects to a peer and exchanges version messages.  If the peer
+// turns out to be incompatible the connection is closed and an error
+// returned.  Either way, the outcome is recorded in the peer list.
+// Must not be called from the request loop.
+func (s *BlockChainServer) dialPeer(node string) (*rpc.Client, error) {
+	info := PeerInfo{Address: node, LastSeen: time.Now()}
+	client, err := s.handshake(node, &info)
+	if err == errSelfConnection {
+		s.addrs.Remove(node)
+		return nil, err
+	}
+	if err != nil {
+		info.Status = err.Error()
+		s.addrs.Failed(node)
+	} else {
+		info.Status = "connected"
+		s.addrs.Good(node)
+	}
+	s.requests <- PeerStatusNotice{info}
+	return client, err
+}
+
+func (s *BlockChainServer) handshake(node string, info *PeerInfo) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", node, PeerCallTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(conn)
+
+	cb := make(chan VersionMessage)
+	s.requests <- VersionRequest{cb}
+	ours := <-cb
+
+	err = callPeer(client, "BlockChainServer.Hello", ours, &info.Version)
+	if err == nil && info.Version.ProtocolVersion == 0 {
+		err = errNoHandshake
+	}
+	if err == nil {
+		err = checkVersion(ours, info.Version)
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Peers call Hello with their version message before anything else.
+// We reply with ours, or with an error if we can't talk to them.
+func (s *BlockChainServer) Hello(theirs VersionMessage, ours *VersionMessage) error {
+	cb := make(chan VersionMessage)
+	s.requests <- VersionRequest{cb}
+	*ours = <-cb
+	return checkVersion(*ours, theirs)
+}
+
+// Serves the RPCs of every connection made to ln.
+func (s *BlockChainServer) acceptPeers(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Println("Accepting connections failed:", err)
+			return
+		}
+		go s.servePeer(conn)
+	}
+}
+
+// Serves the RPCs of one connection made to us.  A peer must complete
+// the handshake before it may call anything but Hello.  Connections
+// from this machine are the node's own client tools, which don't send
+// version messages, so they're let through without one.
+func (s *BlockChainServer) servePeer(conn net.Conn) {
+	local := isLoopback(conn.RemoteAddr())
+	server := rpc.NewServer()
+	server.RegisterName("BlockChainServer", &inboundConn{s, conn.RemoteAddr()})
+	server.ServeCodec(newPeerCodec(conn, local))
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+const helloMethod = "BlockChainServer.Hello"
+
+// The gob codec net/rpc uses by default, which also keeps track of a
+// connection's handshake.  A call to anything but Hello before Hello
+// has succeeded closes the connection, as does a failed Hello, once
+// its error has been sent.
+type peerCodec struct {
+	conn   io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+
+	lock       sync.Mutex
+	handshaken bool
+}
+
+func newPeerCodec(conn io.ReadWriteCloser, handshaken bool) *peerCodec {
+	buf := bufio.NewWriter(conn)
+	return &peerCodec{conn: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf, handshaken: handshaken}
+}
+
+func (c *peerCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.dec.Decode(r)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.handshaken && r.ServiceMethod != helloMethod {
+		return errNoHandshake
+	}
+	return nil
+}
+
+func (c *peerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *peerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	failed := false
+	if r.ServiceMethod == helloMethod {
+		c.lock.Lock()
+		failed = r.Error != ""
+		c.handshaken = c.handshaken || !failed
+		c.lock.Unlock()
+	}
+	err := c.enc.Encode(r)
+	if err == nil {
+		err = c.enc.Encode(body)
+	}
+	if err == nil {
+		err = c.encBuf.Flush()
+	}
+	if err != nil || failed {
+		c.conn.Close()
+	}
+	return err
+}
+
+func (c *peerCodec) Close() error {
+	return c.conn.Close()
+}
+
+// The server as seen by one connection made to it.  Knowing where the
+// connection came from lets Hello work out where to reach a peer that
+// dialed us, so that it can be added to the address table.
+type inboundConn struct {
+	*BlockChainServer
+	remote net.Addr
+}
+
+func (c *inboundConn) Hello(theirs VersionMessage, ours *VersionMessage) error {
+	err := c.BlockChainServer.Hello(theirs, ours)
+	if err != nil || theirs.ListenAddress == "" {
+		return err
+	}
+	addr, err := peerListenAddress(theirs.ListenAddress, c.remote)
+	if err != nil {
+		fmt.Printf("Ignoring listen address %q of %v: %v\n", theirs.ListenAddress, c.remote, err)
+		return nil
+	}
+	c.addrs.Add(addr)
+	return nil
+}
+
+// Only the node's operator may change who it talks to.  Letting any
+// peer do so would let it evict our other peers and point us at hosts
+// of its choosing.
+var errNotLocal = errors.New("peers can only be changed from this machine")
+
+func (c *inboundConn) AddPeer(address string, added *bool) error {
+	if !isLoopback(c.remote) {
+		return errNotLocal
+	}
+	return c.BlockChainServer.AddPeer(address, added)
+}
+
+func (c *inboundConn) RemovePeer(address string, removed *bool) error {
+	if !isLoopback(c.remote) {
+		return errNotLocal
+	}
+	return c.BlockChainServer.RemovePeer(address, removed)
+}
+
+// Works out where a peer that connected from remote accepts
+// connections, given the address it says it listens on.  Nodes
+// usually listen on every interface, as in ":8000", so a missing or
+// unspecified host is taken from the address the peer connected from.
+func peerListenAddress(listen string, remote net.Addr) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host, _, err = net.SplitHostPort(remote.String())
+		if err != nil {
+			return "", err
+		}
+	}
+	return normalizeAddress(net.JoinHostPort(host, port))
+}
+
+// Lists the peers we've connected to and the result of the last
+// handshake with each.
+func (s *BlockChainServer) Peers(unused bool, peers *[]PeerInfo) error {
+	cb := make(chan []PeerInfo)
+	s.requests <- PeersRequest{cb}
+	*peers = <-cb
+	return nil
+}
+
+// Periodically makes sure we're connected to as many peers as we want,
+// asks each for the addresses it knows, and saves the address table.
+func (s *BlockChainServer) managePeers() {
+	for {
+		s.connectPeers()
+		for _, node := range s.conns.Connected() {
+			err := s.conns.Do(node, discoverFrom(s.addrs))
+			if err != nil {
+				fmt.Printf("Could not get addresses from %s: %v\n", node, err)
+			}
+		}
+		err := s.addrs.Flush()
+		if err != nil {
+			fmt.Println("Saving peer addresses failed:", err)
+		}
+		time.Sleep(PeerRefreshInterval)
+	}
+}
+
+// Drops connections to peers that are no longer in the address table
+// and opens connections to new ones, up to MaxPeerConnections.
+func (s *BlockChainServer) connectPeers() {
+	known := make(map[string]bool)
+	for _, addr := range s.addrs.Addresses() {
+		known[addr] = true
+	}
+	for _, addr := range s.conns.Peers() {
+		if !known[addr] {
+			s.conns.Disconnect(addr)
+		}
+	}
+	for _, addr := range s.addrs.Candidates(time.Now()) {
+		if !s.conns.Connect(addr) {
+			break
+		}
+	}
+}
+
+func (s *BlockChainServer) peerConnected(addr string) {
+	fmt.Println("Connected to", addr)
+	go s.syncBlocks()
+}
+
+func (s *BlockChainServer) peerDisconnected(addr string, err error) {
+	fmt.Printf("Lost connection to %s: %v\n", addr, err)
+	s.requests <- PeerDisconnectedNotice{addr, err}
+}
+
+// Asks a peer for the addresses it knows and adds them to the table.
+func discoverFrom(addrs *AddrManager) peerTask {
+	return func(client *rpc.Client) error {
+		var shared []string
+		err := callPeer(client, "BlockChainServer.GetAddresses", true, &shared)
+		if err != nil {
+			return err
+		}
+		if len(shared) > MaxSharedAddresses {
+			shared = shared[:MaxSharedAddresses]
+		}
+		for _, addr := range shared {
+			addrs.Add(addr)
+		}
+		return nil
+	}
+}
+
+// Shares a random selection of the addresses we know.
+func (s *BlockChainServer) GetAddresses(unused bool, addrs *[]string) error {
+	known := s.addrs.Addresses()
+	rand.Shuffle(len(known), func(i, j int) { known[i], known[j] = known[j], known[i] })
+	if len(known) > MaxSharedAddresses {
+		known = known[:MaxSharedAddresses]
+	}
+	*addrs = known
+	return nil
+}
+
+// Answers health checks from the peers connected to us.
+func (s *BlockChainServer) Ping(nonce uint64, pong *uint64) error {
+	*pong = nonce
+	return nil
+}
+
+func (s *BlockChainServer) AddPeer(address string, added *bool) error {
+	addr, err := s.addrs.Add(address)
+	if err != nil {
+		return err
+	}
+	s.conns.Connect(addr)
+	*added = true
+	return s.addrs.Flush()
+}
+
+func (s *BlockChainServer) RemovePeer(address string, removed *bool) error {
+	addr, err := normalizeAddress(address)
+	if err != nil {
+		return err
+	}
+	s.addrs.Remove(addr)
+	s.conns.Disconnect(addr)
+	s.requests <- RemovePeerNotice{addr}
+	*removed = true
+	return s.addrs.Flush()
+}
@@ -0,0 +1,197 @@
+package ktcoin
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+func TestCheckVersion(t *testing.T) {
+	bc := newTestBlockChain()
+	server := newTestServer(t, &bc)
+	ours := server.versionMessage()
+	if ours.GenesisHash != bc.latestBlock || ours.BestHeight != 0 {
+		t.Error("version message does not describe our chain")
+	}
+	if err := checkVersion(ours, ours); err != nil {
+		t.Error(err)
+	}
+
+	otherNetwork := ours
+	otherNetwork.NetworkMagic++
+	if err := checkVersion(ours, otherNetwork); err == nil {
+		t.Error("accepted a peer on another network")
+	}
+
+	otherGenesis := ours
+	otherGenesis.GenesisHash = SHA{1}
+	if err := checkVersion(ours, otherGenesis); err == nil {
+		t.Error("accepted a peer with another genesis block")
+	}
+
+	tooOld := ours
+	tooOld.ProtocolVersion = MinProtocolVersion - 1
+	if err := checkVersion(ours, tooOld); err == nil {
+		t.Error("accepted a peer with an unsupported protocol version")
+	}
+
+	ours.Nonce = 42
+	if err := checkVersion(ours, ours); err != errSelfConnection {
+		t.Error("did not notice a connection to ourselves:", err)
+	}
+	ours.Nonce = 0
+
+	// A newer peer on the same network is fine; height and user agent
+	// don't matter.
+	newer := ours
+	newer.ProtocolVersion++
+	newer.BestHeight = 100
+	newer.UserAgent = "other"
+	if err := checkVersion(ours, newer); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHelloRejectsMismatch(t *testing.T) {
+	bc := newTestBlockChain()
+	server := newTestServer(t, &bc)
+
+	theirs := server.versionMessage()
+	var ours VersionMessage
+	if err := server.Hello(theirs, &ours); err != nil {
+		t.Error(err)
+	}
+	if ours.GenesisHash != bc.latestBlock {
+		t.Error("Hello did not reply with our version")
+	}
+
+	theirs.NetworkMagic++
+	if err := server.Hello(theirs, &ours); err == nil {
+		t.Error("Hello accepted a peer on another network")
+	}
+
+	server.requests <- PeerStatusNotice{PeerInfo{Address: "b", Status: "connected"}}
+	server.requests <- PeerStatusNotice{PeerInfo{Address: "a", Status: "unreachable"}}
+	var peers []PeerInfo
+	server.Peers(true, &peers)
+	if len(peers) != 2 || peers[0].Address != "a" || peers[1].Status != "connected" {
+		t.Error("wrong peer listing:", peers)
+	}
+}
+
+func TestPeerListenAddress(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 51234}
+	cases := map[string]string{
+		":8001":         "10.0.0.5:8001",
+		"0.0.0.0:8001":  "10.0.0.5:8001",
+		"[::]:8001":     "10.0.0.5:8001",
+		"node2:8001":    "node2:8001",
+		"10.0.0.9:8002": "10.0.0.9:8002",
+	}
+	for listen, want := range cases {
+		got, err := peerListenAddress(listen, remote)
+		if err != nil || got != want {
+			t.Errorf("%q from %v: got %q (%v), want %q", listen, remote, got, err, want)
+		}
+	}
+	if _, err := peerListenAddress("nonsense", remote); err == nil {
+		t.Error("accepted a listen address without a port")
+	}
+}
+
+func TestInboundHelloAddsPeer(t *testing.T) {
+	bc := newTestBlockChain()
+	server := newTestServer(t, &bc)
+	server.nonce = 1
+	conn := &inboundConn{server, &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 51234}}
+
+	theirs := server.versionMessage()
+	theirs.Nonce = 2
+	theirs.ListenAddress = ":8001"
+	var ours VersionMessage
+	if err := conn.Hello(theirs, &ours); err != nil {
+		t.Fatal(err)
+	}
+	addresses := server.addrs.Addresses()
+	if len(addresses) != 1 || addresses[0] != "10.0.0.5:8001" {
+		t.Error("peer's listen address not recorded:", addresses)
+	}
+
+	// A peer on another network isn't worth connecting to.
+	theirs.NetworkMagic++
+	theirs.ListenAddress = ":8002"
+	if err := conn.Hello(theirs, &ours); err == nil {
+		t.Error("Hello accepted a peer on another network")
+	}
+	if len(server.addrs.Addresses()) != 1 {
+		t.Error("recorded the address of a rejected peer")
+	}
+}
+
+func TestInboundPeerMustHandshake(t *testing.T) {
+	bc := newTestBlockChain()
+	server := newTestServer(t, &bc)
+	dial := func() *rpc.Client {
+		clientConn, serverConn := net.Pipe()
+		go server.servePeer(serverConn)
+		return rpc.NewClient(clientConn)
+	}
+	var tip SHA
+
+	// A peer that never says hello is cut off.
+	client := dial()
+	if err := client.Call("BlockChainServer.GetTip", true, &tip); err == nil {
+		t.Error("served a peer that skipped the handshake")
+	}
+	client.Close()
+
+	// So is one on another network, once it's been told why.
+	client = dial()
+	theirs := server.versionMessage()
+	theirs.Nonce = server.nonce + 1
+	theirs.NetworkMagic++
+	var ours VersionMessage
+	if err := client.Call("BlockChainServer.Hello", theirs, &ours); err == nil || err == rpc.ErrShutdown {
+		t.Error("expected a network mismatch, got", err)
+	}
+	if err := client.Call("BlockChainServer.GetTip", true, &tip); err == nil {
+		t.Error("connection stayed open after a failed handshake")
+	}
+	client.Close()
+
+	client = dial()
+	defer client.Close()
+	theirs.NetworkMagic--
+	if err := client.Call("BlockChainServer.Hello", theirs, &ours); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("BlockChainServer.GetTip", true, &tip); err != nil || tip != bc.latestBlock {
+		t.Error("did not serve a peer after the handshake:", err)
+	}
+}
+
+func TestPeersChangedOnlyLocally(t *testing.T) {
+	bc := newTestBlockChain()
+	server := newTestServer(t, &bc)
+	server.addrs.Add("10.0.0.9:8000")
+
+	var ok bool
+	remote := &inboundConn{server, &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 51234}}
+	if err := remote.AddPeer("10.0.0.6:8000", &ok); err != errNotLocal {
+		t.Error("a remote peer added a peer:", err)
+	}
+	if err := remote.RemovePeer("10.0.0.9:8000", &ok); err != errNotLocal {
+		t.Error("a remote peer removed a peer:", err)
+	}
+	if addresses := server.addrs.Addresses(); len(addresses) != 1 {
+		t.Error("address table changed:", addresses)
+	}
+
+	local := &inboundConn{server, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51234}}
+	if err := local.RemovePeer("10.0.0.9:8000", &ok); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.addrs.Addresses()) != 0 {
+		t.Error("a local client could not remove a peer")
+	}
+}
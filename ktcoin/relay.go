@@ -0,0 +1,126 @@
+package ktcoin
+
+import (
+	"net/rpc"
+)
+
+// How many transaction hashes a node remembers having seen.
+const MaxSeenTransactions = 10000
+
+// Transactions are relayed in two steps.  A node that accepts a new
+// transaction into its pending list announces the hash to each of its
+// peers with an inventory message.  Each peer replies with the hashes
+// it hasn't seen, and the node sends it just those transactions.  A
+// peer that accepts one announces it in turn; since a node never
+// announces or asks for a transaction it has already seen, each
+// transaction crosses each connection at most once in each direction
+// and relaying stops once every node has it.  Nor does a node ask again
+// for a transaction it rejected, until a new block might have made it
+// valid.
+//
+// Blocks are relayed the same way.  A node announces a block received
+// from a peer once it becomes the new tip, and peers ask only for
+// blocks they don't already have.
+type InventoryMessage struct {
+	Hashes []SHA
+	Blocks []SHA
+}
+
+type InventoryRequest struct {
+	hashes          []SHA
+	blocks          []SHA
+	callbackChannel chan []SHA
+}
+
+func (req InventoryRequest) rpcHandle(server *BlockChainServer) {
+	wanted := make([]SHA, 0)
+	for _, hash := range req.hashes {
+		if !server.seen.has(hash) && !server.rejected.has(hash) {
+			wanted = append(wanted, hash)
+		}
+	}
+	for _, hash := range req.blocks {
+		if _, ok := server.blockchain.blocks[hash]; !ok {
+			wanted = append(wanted, hash)
+		}
+	}
+	req.callbackChannel <- wanted
+}
+
+// A bounded set of transaction hashes, forgetting the oldest once it
+// holds limit hashes.
+type seenCache struct {
+	hashes map[SHA]bool
+	order  []SHA
+	limit  int
+}
+
+func newSeenCache(limit int) *seenCache {
+	return &seenCache{make(map[SHA]bool), make([]SHA, 0, limit), limit}
+}
+
+func (c *seenCache) add(hash SHA) {
+	if c.hashes[hash] {
+		return
+	}
+	if len(c.order) >= c.limit {
+		delete(c.hashes, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.hashes[hash] = true
+	c.order = append(c.order, hash)
+}
+
+func (c *seenCache) has(hash SHA) bool {
+	return c.hashes[hash]
+}
+
+// Announces a transaction to every connected peer and sends it to
+// those that ask for it.  Runs in its own goroutine so that slow peers
+// don't hold up the request loop.
+func (s *BlockChainServer) announceTransaction(tx Transaction) {
+	inv := InventoryMessage{[]SHA{tx.Hash()}, nil}
+	s.conns.Broadcast(func(client *rpc.Client) error {
+		return announceTo(client, inv, []Transaction{tx}, nil)
+	})
+}
+
+// Announces a new tip block to every connected peer and sends it to
+// those that don't have it yet.
+func (s *BlockChainServer) announceBlock(block Block) {
+	inv := InventoryMessage{nil, []SHA{block.Hash()}}
+	s.conns.Broadcast(func(client *rpc.Client) error {
+		return announceTo(client, inv, nil, []Block{block})
+	})
+}
+
+func announceTo(client *rpc.Client, inv InventoryMessage, txs []Transaction, blocks []Block) error {
+	var wanted []SHA
+	err := callPeer(client, "BlockChainServer.Inventory", inv, &wanted)
+	if err != nil {
+		return err
+	}
+	for _, hash := range wanted {
+		for _, tx := range txs {
+			if tx.Hash() != hash {
+				continue
+			}
+			var accepted bool
+			err = callPeer(client, "BlockChainServer.NewTransaction", tx, &accepted)
+			if err != nil {
+				return err
+			}
+		}
+		for _, block := range blocks {
+			if block.Hash() != hash {
+				continue
+			}
+			var result bool // unused
+			err = callPeer(client, "BlockChainServer.NewBlock", block, &result)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
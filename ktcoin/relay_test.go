@@ -0,0 +1,98 @@
+package ktcoin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestSeenCache(t *testing.T) {
+	cache := newSeenCache(2)
+	a, b, c := SHA{1}, SHA{2}, SHA{3}
+	cache.add(a)
+	cache.add(b)
+	cache.add(a)
+	if !cache.has(a) || !cache.has(b) {
+		t.Fatal("cache forgot a hash too early")
+	}
+	cache.add(c)
+	if cache.has(a) || !cache.has(b) || !cache.has(c) {
+		t.Error("cache did not forget the oldest hash")
+	}
+}
+
+func TestInventory(t *testing.T) {
+	bc := newTestBlockChain()
+	alice, _ := rsa.GenerateKey(rand.Reader, 1024)
+	bob, _ := rsa.GenerateKey(rand.Reader, 1024)
+	coinbase := testCoinbase(alice, bc.latestBlock)
+	if err := bc.addNextBlock(10000, 0, []Transaction{coinbase}); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, &bc)
+
+	inventory := func(hashes ...SHA) []SHA {
+		cb := make(chan []SHA, 1)
+		InventoryRequest{hashes, nil, cb}.rpcHandle(server)
+		return <-cb
+	}
+	submit := func(tx *Transaction) error {
+		cb := make(chan error, 1)
+		TransactionRequest{*tx, cb}.rpcHandle(server)
+		return <-cb
+	}
+
+	tx, _ := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(bob.PublicKey), 25}}, 0)
+	other := SHA{7}
+	if wanted := inventory(tx.Hash(), other); len(wanted) != 2 {
+		t.Fatalf("wanted %d of 2 unseen transactions", len(wanted))
+	}
+
+	if err := submit(tx); err != nil {
+		t.Fatal(err)
+	}
+	wanted := inventory(tx.Hash(), other)
+	if len(wanted) != 1 || wanted[0] != other {
+		t.Error("asked for a transaction we already have")
+	}
+
+	// A transaction relayed back to us after it's mined is still
+	// recognized, so it isn't accepted or announced again.
+	server.mempool.Remove(tx.Hash())
+	if err := submit(tx); err == nil {
+		t.Error("accepted a transaction we've already seen")
+	}
+	if len(inventory(tx.Hash())) != 0 {
+		t.Error("asked for a mined transaction")
+	}
+
+	// Blocks are asked for until we have them.
+	block := mineTestBlock(&bc, bc.latestBlock, []Transaction{testCoinbase(bob, bc.latestBlock)})
+
+	// A transaction we rejected isn't asked for again until a new
+	// block might make it valid.
+	early, _ := NewTransaction(outputsOf(&block.Transactions[0]), bob, []Payment{{AddressFromKey(alice.PublicKey), 25}}, 0)
+	if err := submit(early); err == nil {
+		t.Fatal("accepted a transaction spending an unknown output")
+	}
+	if len(inventory(early.Hash())) != 0 {
+		t.Error("asked for a transaction we rejected")
+	}
+	blocks := func(hashes ...SHA) []SHA {
+		cb := make(chan []SHA, 1)
+		InventoryRequest{nil, hashes, cb}.rpcHandle(server)
+		return <-cb
+	}
+	if wanted := blocks(block.Hash(), bc.latestBlock); len(wanted) != 1 || wanted[0] != block.Hash() {
+		t.Error("wrong blocks wanted:", wanted)
+	}
+	if err := bc.addBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks(block.Hash())) != 0 {
+		t.Error("asked for a block we already have")
+	}
+	if len(inventory(early.Hash())) != 1 {
+		t.Error("did not ask again for a rejected transaction after a new block")
+	}
+}
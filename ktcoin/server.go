@@ -1,19 +1,23 @@
 package ktcoin
 
 import (
-	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
-	"net/rpc"
 	"os"
+	"path/filepath"
+	"time"
 )
 
-const NonceAttempts = 10000
+// How often the miner's hash rate is reported.
+const HashRateInterval = time.Minute
 
-const NonceDifficulty = 2
+// The most transactions (besides the coinbase) the miner will put in
+// one block.  When more are waiting, those paying the highest fee
+// rates go first.
+const MaxBlockTransactions = 1000
 
 type TransactionRequest struct {
 	tx              Transaction
@@ -21,17 +25,25 @@ type TransactionRequest struct {
 }
 
 type OpenInputRequest struct {
-	key             rsa.PublicKey
-	callbackChannel chan map[SHA]int
+	address         Address
+	callbackChannel chan map[OutPoint]int
 }
 
 type GetBlockRequest struct {
 	sha             SHA
-	callbackChannel chan Block
+	callbackChannel chan *Block
 }
 
+type GetTipRequest struct {
+	callbackChannel chan SHA
+}
+
+// Blocks arrive either from a peer broadcasting a newly mined block,
+// in which case nobody waits for the result, or from the sync
+// process, which needs to know whether each block was accepted.
 type NewBlockNotice struct {
-	block Block
+	block           Block
+	callbackChannel chan error
 }
 
 type RPCHandler interface {
@@ -39,59 +51,169 @@ type RPCHandler interface {
 }
 
 func (req TransactionRequest) rpcHandle(server *BlockChainServer) {
-	err := server.blockchain.Verify(&req.tx)
+	if server.seen.has(req.tx.Hash()) {
+		req.callbackChannel <- errors.New("transaction has already been seen")
+		return
+	}
+	err := server.mempool.CheckConflicts(&req.tx)
+	fee := 0
+	if err == nil {
+		fee, err = server.blockchain.verifyTransaction(&req.tx)
+	}
 	if err == nil {
-		server.openTransactions = append(server.openTransactions, req.tx)
+		err = server.mempool.Add(req.tx, fee, time.Now())
+	}
+	if err == nil {
+		server.mempoolChanged = true
+		server.seen.add(req.tx.Hash())
+		go server.announceTransaction(req.tx)
+	} else {
+		server.rejected.add(req.tx.Hash())
 	}
 	req.callbackChannel <- err
 }
 
-func (req OpenInputRequest) rpcHandle(server *BlockChainServer) {
-	req.callbackChannel <- server.blockchain.GetOpenInputs(req.key)
+// Keeps the mempool in step with the main chain.  Transactions in a
+// newly connected block, and any that conflict with them, leave the
+// pool.  Transactions rejected before may be valid on the new chain.
+func (s *BlockChainServer) BlockConnected(block *Block) {
+	s.mempool.BlockConnected(block)
+	s.mempoolChanged = true
+	s.rejected = newSeenCache(MaxSeenTransactions)
 }
 
-func (req GetBlockRequest) rpcHandle(server *BlockChainServer) {
-	req.callbackChannel <- server.blockchain.blocks[req.sha]
+// Transactions in a block that leaves the main chain during a
+// reorganization go back into the pool, once the reorganization is
+// over, if they're still valid on the new chain.
+func (s *BlockChainServer) BlockDisconnected(block *Block) {
+	s.disconnected = append(s.disconnected, *block)
 }
 
-func (notice NewBlockNotice) rpcHandle(server *BlockChainServer) {
-	// Validate the block.  1. Transactions must be valid.  2. Block
-	// must hash to a difficult-enough SHA.  3. Block's previous hash
-	// must equal s.blockchain.latestBlock, or link back to it
-	// eventually.
-	for i, t := range notice.block.Transactions {
-		if i > 0 {
-			err := server.blockchain.Verify(&t)
-			if err != nil {
-				fmt.Println(err)
-				return
+// Returns the transactions from blocks disconnected by the last chain
+// update to the mempool.  Blocks are disconnected from the tip down,
+// so they're restored in reverse, oldest first.  Transactions already
+// pending are checked again first: one may spend an output that only
+// existed on the old chain, such as the coinbase of a disconnected
+// block.
+func (s *BlockChainServer) restoreDisconnected() {
+	if len(s.disconnected) == 0 {
+		return
+	}
+	for _, pending := range s.mempool.Entries() {
+		_, err := s.blockchain.verifyTransaction(&pending.tx)
+		if err != nil {
+			fmt.Printf("Dropping pending transaction %x: %v\n", pending.hash, err)
+			s.mempool.Remove(pending.hash)
+			s.mempoolChanged = true
+		}
+	}
+
+	now := time.Now()
+	for i := len(s.disconnected) - 1; i >= 0; i-- {
+		// The coinbase can't be mined in any other block.
+		for _, tx := range s.disconnected[i].Transactions[1:] {
+			if _, mined := s.blockchain.txIndex[tx.Hash()]; mined {
+				continue
+			}
+			fee, err := s.blockchain.verifyTransaction(&tx)
+			if err == nil {
+				err = s.mempool.Add(tx, fee, now)
+			}
+			if err == nil {
+				s.mempoolChanged = true
 			}
 		}
-		// TODO: validate the first special tx
 	}
+	s.disconnected = nil
+}
 
-	if !notice.block.isValid(NonceDifficulty) {
-		fmt.Println("block hash does not satisfy proof of work")
-		return
+func (req OpenInputRequest) rpcHandle(server *BlockChainServer) {
+	req.callbackChannel <- server.spendableInputs(req.address)
+}
+
+// Returns the open outputs paid to an address that it can still spend,
+// leaving out those already spent by a pending transaction.
+func (s *BlockChainServer) spendableInputs(address Address) map[OutPoint]int {
+	inputs := s.blockchain.GetOpenInputs(address)
+	for outPoint := range inputs {
+		if s.mempool.Spends(outPoint) {
+			delete(inputs, outPoint)
+		}
 	}
+	return inputs
+}
 
-	if notice.block.PrevHash != server.blockchain.latestBlock {
-		fmt.Println("block is not next in the chain")
+func (req GetBlockRequest) rpcHandle(server *BlockChainServer) {
+	block, ok := server.blockchain.blocks[req.sha]
+	if ok {
+		req.callbackChannel <- &block
+	} else {
+		req.callbackChannel <- nil
+	}
+}
+
+func (req GetTipRequest) rpcHandle(server *BlockChainServer) {
+	req.callbackChannel <- server.blockchain.latestBlock
+}
+
+func (notice NewBlockNotice) rpcHandle(server *BlockChainServer) {
+	// Validate the block.  1. Block must have the right target and a
+	// sane timestamp, and hash to a value below the target.  2.
+	// Block's previous hash must be a block we already know about.  3.
+	// Transactions, including the coinbase, must pass ValidateBlock
+	// when the block is connected.  Blocks that don't extend the
+	// current tip are kept as a side branch, and become the main chain
+	// if they end up with more work.
+	previousTip := server.blockchain.latestBlock
+	err := server.blockchain.addBlock(notice.block)
+	server.restoreDisconnected()
+	if notice.callbackChannel != nil {
+		notice.callbackChannel <- err
+	}
+	if err == errUnknownParent {
+		// We've missed at least one block; fetch whatever we're
+		// missing from our peers.
+		fmt.Println("Received a block with an unknown parent; syncing.")
+		go server.syncBlocks()
+		return
+	}
+	if err != nil {
+		fmt.Println("Rejecting block:", err)
 		return
 	}
 
-	fmt.Println("Accepting block.")
-	blockSha := notice.block.Hash()
-	server.blockchain.blocks[blockSha] = notice.block
-	server.blockchain.latestBlock = blockSha
+	if tip, height := server.blockchain.Tip(); tip != previousTip {
+		fmt.Printf("Accepting block; new tip %v at height %d\n", &tip, height)
+		// Pass on blocks announced to us.  Blocks fetched by a
+		// sync are old news to our other peers.
+		if notice.callbackChannel == nil && tip == notice.block.Hash() {
+			go server.announceBlock(notice.block)
+		}
+	} else {
+		fmt.Println("Accepting block on a side branch.")
+	}
 }
 
 type BlockChainServer struct {
-	requests         chan RPCHandler
-	knownNodes       []string
-	openTransactions []Transaction
-	blockchain       *BlockChain
-	currentNonce     int
+	requests      chan RPCHandler
+	addrs         *AddrManager
+	conns         *ConnManager
+	mempool       *Mempool
+	disconnected  []Block
+	seen          *seenCache
+	rejected      *seenCache
+	peers         map[string]PeerInfo
+	nonce         uint64
+	listenAddress string
+	blockchain    *BlockChain
+	syncing       int32
+
+	// Unless mining is turned off, the miner works on template until
+	// the tip or the pending transactions change.
+	mining         bool
+	miner          *Miner
+	template       Block
+	mempoolChanged bool
 }
 
 //// Procedures for client-server communication
@@ -110,9 +232,9 @@ func (s *BlockChainServer) Transact(tx Transaction, accepted *bool) error {
 	}
 }
 
-func (s *BlockChainServer) GetOpenInputs(key rsa.PublicKey, openInputs *map[SHA]int) error {
-	callbackChannel := make(chan map[SHA]int)
-	openInputRequest := OpenInputRequest{key, callbackChannel}
+func (s *BlockChainServer) GetOpenInputs(address Address, openInputs *map[OutPoint]int) error {
+	callbackChannel := make(chan map[OutPoint]int)
+	openInputRequest := OpenInputRequest{address, callbackChannel}
 	s.requests <- openInputRequest
 
 	*openInputs = <-callbackChannel
@@ -122,102 +244,242 @@ func (s *BlockChainServer) GetOpenInputs(key rsa.PublicKey, openInputs *map[SHA]
 //// Procedures for server-to-server communication
 
 func (s *BlockChainServer) GetBlock(sha SHA, block *Block) error {
-	cb := make(chan Block)
+	cb := make(chan *Block)
 	s.requests <- GetBlockRequest{sha, cb}
-	*block = <-cb
-	if block == nil {
+	found := <-cb
+	if found == nil {
 		return errors.New("nonexistent block")
 	}
+	*block = *found
+	return nil
+}
+
+// Replies with the blocks of our main chain that follow the last block
+// in the locator we have, up to MaxSyncBatch of them.
+func (s *BlockChainServer) GetBlocks(locator []SHA, blocks *[]Block) error {
+	cb := make(chan []Block)
+	s.requests <- GetBlocksRequest{locator, cb}
+	*blocks = <-cb
+	return nil
+}
+
+func (s *BlockChainServer) GetTip(unused bool, tip *SHA) error {
+	cb := make(chan SHA)
+	s.requests <- GetTipRequest{cb}
+	*tip = <-cb
 	return nil
 }
 
 func (s *BlockChainServer) NewBlock(block Block, accepted *bool) error {
-	s.requests <- NewBlockNotice{block}
+	s.requests <- NewBlockNotice{block, nil}
 	return nil
 }
 
-func (s *BlockChainServer) NewTransaction(transaction Transaction, accepted *bool) error {
-	//TODO
+// Peers tell us about transactions they've accepted and blocks they've
+// added to their tip by hash; we reply with the hashes we want them to
+// send with NewTransaction or NewBlock.
+func (s *BlockChainServer) Inventory(inv InventoryMessage, wanted *[]SHA) error {
+	cb := make(chan []SHA)
+	s.requests <- InventoryRequest{inv.Hashes, inv.Blocks, cb}
+	*wanted = <-cb
 	return nil
 }
 
+func (s *BlockChainServer) NewTransaction(transaction Transaction, accepted *bool) error {
+	callbackChannel := make(chan error)
+	s.requests <- TransactionRequest{transaction, callbackChannel}
+	err := <-callbackChannel
+	*accepted = err == nil
+	return err
+}
+
 func runServer(server *BlockChainServer, key *rsa.PrivateKey) {
 	fmt.Println("Running server...")
+	hashRateTicker := time.NewTicker(HashRateInterval)
+	expiryTicker := time.NewTicker(MempoolExpiryInterval)
+	server.startMining(key)
 	for {
 		select {
 		case req := <-server.requests:
 			req.rpcHandle(server)
-		// Otherwise keep mining for blocks
-		default:
-			// Hack: in order to make each coin unique, the
-			// transaction that initiates it has a fake input SHA,
-			// which is the SHA of the previous block.
-
-			outputs := make(map[string]int)
-			outputs[publicKeyString(key.PublicKey)] = 25
-			inputs := []SHA{server.blockchain.latestBlock}
-			toSign, _ := bytesToSign(key.PublicKey, inputs)
-			signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, toSign[:])
-			genesisTx := Transaction{
-				inputs,
-				key.PublicKey,
-				key.PublicKey,
-				outputs,
-				signature,
+			if server.templateStale() {
+				server.startMining(key)
 			}
-			txs := append([]Transaction{genesisTx}, server.openTransactions...)
-
-			err = server.blockchain.addNextBlock(NonceDifficulty, NonceAttempts, server.currentNonce, txs)
-			if err != nil {
-				server.currentNonce += NonceAttempts
-				if err.Error() != "limit reached" {
-					fmt.Println(err)
-				}
-			} else {
-				server.openTransactions = make([]Transaction, 0)
-				fmt.Println("New Block found")
-				latestBlock := server.blockchain.blocks[server.blockchain.latestBlock]
-				fmt.Println("Block: ", &latestBlock)
-				for i, node := range server.knownNodes {
-					fmt.Printf("Sending block to node %d (%s)\n", i, node)
-					client, err := rpc.Dial("tcp", node+":8000")
-					if err != nil {
-						fmt.Println(err)
-						break
-					}
-
-					var result bool // unused
-					go func() {
-						client.Call("BlockChainServer.NewBlock", latestBlock, &result)
-						if err != nil {
-							fmt.Println(err)
-						}
-					}()
+		case block := <-server.miner.Found():
+			server.acceptMinedBlock(block)
+			server.startMining(key)
+		case <-hashRateTicker.C:
+			if !server.mining {
+				continue
+			}
+			hashes := server.miner.TakeHashes()
+			fmt.Printf("Mining at %.0f hashes/s\n", float64(hashes)/HashRateInterval.Seconds())
+		case now := <-expiryTicker.C:
+			if expired := server.mempool.Expire(now); expired > 0 {
+				fmt.Printf("Dropped %d expired transactions from the mempool\n", expired)
+				server.mempoolChanged = true
+				if server.templateStale() {
+					server.startMining(key)
 				}
 			}
 		}
 	}
 }
 
-func RunNode(knownNodes []string, key *rsa.PrivateKey) {
-	bc := NewBlockChain()
+// Returns true if the block being mined no longer extends the tip or
+// no longer reflects the pending transactions.
+func (s *BlockChainServer) templateStale() bool {
+	if !s.mining {
+		return false
+	}
+	return s.mempoolChanged || s.template.PrevHash != s.blockchain.latestBlock
+}
+
+// Builds a new block template from the current tip and the pending
+// transactions paying the highest fee rates, and sets the miner to
+// work on it.
+func (s *BlockChainServer) startMining(key *rsa.PrivateKey) {
+	s.miner.Stop()
+	s.mempoolChanged = false
+	if !s.mining {
+		return
+	}
+
+	// Check the block before spending any effort mining it.  A pending
+	// transaction that makes the template invalid, such as one whose
+	// inputs a new block spent, is dropped from the mempool and the
+	// template built again without it.  If the template is invalid
+	// for any other reason, a block of just the coinbase is mined.
+	included := s.mempool.Best(MaxBlockTransactions)
+	for {
+		template := s.blockTemplate(key, included)
+		err := s.blockchain.ValidateBlock(&template)
+		if err == nil {
+			s.template = template
+			s.miner.Mine(s.template)
+			return
+		}
+
+		var invalid *BlockTransactionError
+		if errors.As(err, &invalid) && invalid.Index > 0 && invalid.Index <= len(included) {
+			bad := included[invalid.Index-1].hash
+			fmt.Printf("Dropping pending transaction %x: %v\n", bad, invalid.Err)
+			s.mempool.Remove(bad)
+			included = append(included[:invalid.Index-1:invalid.Index-1], included[invalid.Index:]...)
+			continue
+		}
+		if len(included) == 0 {
+			fmt.Println("Not mining invalid block template:", err)
+			return
+		}
+		fmt.Println("Block template is invalid; mining without pending transactions:", err)
+		included = nil
+	}
+}
+
+// Builds a block on the current tip from the given pending
+// transactions, with a coinbase claiming the block reward and their
+// fees.
+func (s *BlockChainServer) blockTemplate(key *rsa.PrivateKey, included []pendingTransaction) Block {
+	fees := 0
+	for _, pending := range included {
+		fees += pending.fee
+	}
+
+	// Hack: in order to make each coin unique, the transaction that
+	// initiates it has a fake input, which points at the previous
+	// block.
+	coinbase := NewCoinbase(AddressFromKey(key.PublicKey), s.blockchain.latestBlock, BlockReward+fees)
+	txs := []Transaction{*coinbase}
+	for _, pending := range included {
+		txs = append(txs, pending.tx)
+	}
+	return s.blockchain.newBlockTemplate(0, txs)
+}
+
+// Adds a block found by the miner to the chain and sends it to our
+// peers.  A block solved just as its template went stale is dropped.
+func (s *BlockChainServer) acceptMinedBlock(block Block) {
+	if block.PrevHash != s.template.PrevHash || block.MerkleRoot != s.template.MerkleRoot {
+		return
+	}
+	s.miner.Stop()
+	err := s.blockchain.addBlock(block)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("New Block found")
+	fmt.Println("Block: ", &block)
+	go s.announceBlock(block)
+}
+
+func RunNode(cfg Config) {
+	err := cfg.Validate()
+	if err != nil {
+		fmt.Println("Invalid configuration:", err)
+		os.Exit(1)
+	}
+	key, err := LoadKey(cfg.KeyFile, PromptPassphrase("Passphrase for "+cfg.KeyFile+": "))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	bc, err := OpenBlockChain(cfg.DataDir, cfg.Chain)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	addrs := NewAddrManager(filepath.Join(cfg.DataDir, peerFileName), MaxKnownAddresses)
+	err = addrs.Load()
+	if err != nil {
+		fmt.Println("Could not load peer addresses:", err)
+	}
+	for _, node := range cfg.Peers {
+		_, err := addrs.Add(node)
+		if err != nil {
+			fmt.Printf("Ignoring peer %q: %v\n", node, err)
+		}
+	}
+
 	requests := make(chan RPCHandler)
 	server := BlockChainServer{
 		requests,
-		knownNodes,
-		[]Transaction{},
-		&bc,
+		addrs,
+		nil,
+		NewMempool(MaxMempoolSize, MempoolExpiry),
+		nil,
+		newSeenCache(MaxSeenTransactions),
+		newSeenCache(MaxSeenTransactions),
+		make(map[string]PeerInfo),
+		rand.Uint64(),
+		cfg.ListenAddress,
+		bc,
 		0,
+		cfg.Mining,
+		NewMiner(cfg.Workers),
+		Block{},
+		false,
 	}
 
-	rpc.Register(&server)
-	ln, err := net.Listen("tcp", ":8000")
+	bc.listener = &server
+	server.conns = NewConnManager(server.dialPeer, server.peerConnected, server.peerDisconnected)
+
+	ln, err := net.Listen("tcp", cfg.ListenAddress)
 
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	if cfg.APIAddress != "" {
+		go func() {
+			err := NewAPIServer(cfg.APIAddress, &server).ListenAndServe()
+			fmt.Println("HTTP API stopped:", err)
+		}()
+	}
+
 	go runServer(&server, key)
-	rpc.Accept(ln)
+	go server.managePeers()
+	server.acceptPeers(ln)
 }
@@ -0,0 +1,122 @@
+package ktcoin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+)
+
+// Starts a server following bc with its request loop running but no
+// miner or peers.
+func newTestServer(t *testing.T, bc *BlockChain) *BlockChainServer {
+	server := &BlockChainServer{
+		requests:   make(chan RPCHandler),
+		addrs:      NewAddrManager("", MaxKnownAddresses),
+		mempool:    NewMempool(MaxMempoolSize, MempoolExpiry),
+		seen:       newSeenCache(10),
+		rejected:   newSeenCache(10),
+		peers:      make(map[string]PeerInfo),
+		blockchain: bc,
+		conns:      NewConnManager(nil, nil, nil),
+	}
+	bc.listener = server
+	go func() {
+		for req := range server.requests {
+			req.rpcHandle(server)
+		}
+	}()
+	t.Cleanup(func() { close(server.requests) })
+	return server
+}
+
+func TestPendingDoubleSpend(t *testing.T) {
+	bc := newTestBlockChain()
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+	coinbase := testCoinbase(alice, bc.latestBlock)
+	if err := bc.addNextBlock(10000, 0, []Transaction{coinbase}); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, &bc)
+
+	submit := func(tx *Transaction) error {
+		callbackChannel := make(chan error, 1)
+		TransactionRequest{*tx, callbackChannel}.rpcHandle(server)
+		return <-callbackChannel
+	}
+
+	toBob, _ := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(bob.PublicKey), 25}}, 0)
+	toAlice, _ := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(alice.PublicKey), 25}}, 0)
+	if err := submit(toBob); err != nil {
+		t.Fatal(err)
+	}
+	if err := submit(toBob); err == nil {
+		t.Error("accepted the same transaction twice")
+	}
+	openInputs := make(chan map[OutPoint]int, 1)
+	OpenInputRequest{AddressFromKey(alice.PublicKey), openInputs}.rpcHandle(server)
+	if inputs := <-openInputs; len(inputs) != 0 {
+		t.Error("offered an input that's already pending:", inputs)
+	}
+
+	err := submit(toAlice)
+	conflict, ok := err.(*ConflictError)
+	if !ok || conflict.ConflictsWith != toBob.Hash() {
+		t.Fatal("expected a conflict with the first transaction, got", err)
+	}
+	if server.mempool.Len() != 1 {
+		t.Error("conflicting transaction was added to the pending list")
+	}
+
+	// Once the first spend is mined the input is no longer pending,
+	// but it's no longer open either.
+	block := mineTestBlock(&bc, bc.latestBlock, []Transaction{testCoinbase(alice, bc.latestBlock), *toBob})
+	if err := bc.addBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if server.mempool.Len() != 0 || len(server.mempool.spends) != 0 {
+		t.Error("mined transaction is still pending")
+	}
+}
+
+func TestMiningDropsInvalidTransaction(t *testing.T) {
+	bc := newTestBlockChain()
+	alice, _ := rsa.GenerateKey(rand.Reader, 1024)
+	bob, _ := rsa.GenerateKey(rand.Reader, 1024)
+	coinbase := testCoinbase(alice, bc.latestBlock)
+	if err := bc.addNextBlock(10000, 0, []Transaction{coinbase}); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, &bc)
+	server.mining = true
+	server.miner = NewMiner(1)
+	defer server.miner.Stop()
+
+	good, _ := NewTransaction(outputsOf(&coinbase), alice, []Payment{{AddressFromKey(bob.PublicKey), 20}}, 1)
+	fee, err := bc.verifyTransaction(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mempool.Add(*good, fee, time.Now())
+	// A pending transaction whose input isn't open, such as one that a
+	// reorganization left behind, paying a higher fee so it comes first.
+	bad, _ := NewTransaction(map[OutPoint]int{{SHA{1}, 0}: 25}, alice, []Payment{{AddressFromKey(bob.PublicKey), 20}}, 5)
+	server.mempool.Add(*bad, 5, time.Now())
+
+	server.startMining(bob)
+	if server.mempool.Has(bad.Hash()) || !server.mempool.Has(good.Hash()) {
+		t.Error("expected only the invalid transaction to be dropped")
+	}
+	if len(server.template.Transactions) != 2 || server.template.Transactions[1].Hash() != good.Hash() {
+		t.Fatal("template does not include the valid transaction")
+	}
+	select {
+	case block := <-server.miner.Found():
+		if block.MerkleRoot != server.template.MerkleRoot {
+			t.Error("miner solved the wrong template")
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("miner is not running")
+	}
+}
@@ -0,0 +1,315 @@
+package ktcoin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The block store keeps every accepted block on disk so that a node
+// can rebuild its chain after a restart.  It consists of two files:
+//
+//   - blocks.dat: an append-only sequence of records, each made up
+//     of a magic number, the payload length, a CRC32 checksum of the
+//     payload and the gob-encoded block itself.
+//   - blocks.idx: a sequence of fixed-size entries mapping each
+//     block's SHA to the offset and length of its record in
+//     blocks.dat.
+//
+// Both files are fsynced after every write.  Since the data file is
+// written first, a crash can leave at most a partial record at the
+// end of the data file and an index that is missing entries; both are
+// repaired when the store is opened.  Otherwise blocks are found
+// through the index when the store is opened, and the data file is
+// only scanned past its last entry.
+type BlockStore struct {
+	dataFile  *os.File
+	indexFile *os.File
+	offsets   map[SHA]int64
+	entries   int64
+	size      int64
+}
+
+const (
+	blockFileName  = "blocks.dat"
+	indexFileName  = "blocks.idx"
+	recordMagic    = 0x6b746362 // "ktcb"
+	recordHeader   = 12
+	maxRecordSize  = 32 << 20
+	indexEntrySize = 32 + 8 + 4
+)
+
+type storedBlock struct {
+	sha    SHA
+	offset int64
+	length uint32
+	block  Block
+}
+
+// Opens the block store in dir, creating it if necessary, and returns
+// the stored blocks in the order they were written.
+func OpenBlockStore(dir string) (*BlockStore, []Block, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataFile, err := os.OpenFile(filepath.Join(dir, blockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	indexFile, err := os.OpenFile(filepath.Join(dir, indexFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		dataFile.Close()
+		return nil, nil, err
+	}
+
+	store := &BlockStore{dataFile, indexFile, make(map[SHA]int64), 0, 0}
+	records, err := store.recover()
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+
+	blocks := make([]Block, 0, len(records))
+	store.entries = int64(len(records))
+	for _, record := range records {
+		store.offsets[record.sha] = record.offset
+		blocks = append(blocks, record.block)
+	}
+	return store, blocks, nil
+}
+
+// Finds the complete records in the data file and brings the index
+// back in line with them.  Records listed in the index are located
+// through it; only records written after the last index entry, which
+// a crash may have left unindexed, are found by scanning the data
+// file.  Any partial or corrupt record at the end is truncated.
+func (store *BlockStore) recover() ([]storedBlock, error) {
+	records, err := store.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	if len(records) > 0 {
+		last := records[len(records)-1]
+		offset = last.offset + recordHeader + int64(last.length)
+	}
+	for {
+		block, length, err := readRecord(store.dataFile, offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf("Truncating block store at offset %d: %v\n", offset, err)
+			break
+		}
+		records = append(records, storedBlock{block.Hash(), offset, length, block})
+		offset += recordHeader + int64(length)
+	}
+
+	info, err := store.dataFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != offset {
+		err = store.dataFile.Truncate(offset)
+		if err != nil {
+			return nil, err
+		}
+		err = store.dataFile.Sync()
+		if err != nil {
+			return nil, err
+		}
+	}
+	store.size = offset
+
+	return records, store.repairIndex(records)
+}
+
+// Reads the records listed in the index, in order.  Reading stops at
+// the first entry that doesn't follow on from the one before or whose
+// record is missing, corrupt or holds a different block, since the
+// data file is always written before the index.
+func (store *BlockStore) readIndex() ([]storedBlock, error) {
+	info, err := store.indexFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	entries := int(info.Size() / indexEntrySize)
+
+	records := make([]storedBlock, 0, entries)
+	var expected int64
+	entry := make([]byte, indexEntrySize)
+	for i := 0; i < entries; i++ {
+		_, err = store.indexFile.ReadAt(entry, int64(i)*indexEntrySize)
+		if err != nil {
+			return nil, err
+		}
+		var sha SHA
+		copy(sha[:], entry)
+		offset := int64(binary.BigEndian.Uint64(entry[32:]))
+		length := binary.BigEndian.Uint32(entry[40:])
+		if offset != expected {
+			break
+		}
+		block, readLength, err := readRecord(store.dataFile, offset)
+		if err != nil || readLength != length || block.Hash() != sha {
+			break
+		}
+		records = append(records, storedBlock{sha, offset, length, block})
+		expected = offset + recordHeader + int64(length)
+	}
+	return records, nil
+}
+
+// Keeps the longest prefix of the index that agrees with the data
+// file and rewrites the rest.
+func (store *BlockStore) repairIndex(records []storedBlock) error {
+	info, err := store.indexFile.Stat()
+	if err != nil {
+		return err
+	}
+	entries := int(info.Size() / indexEntrySize)
+
+	valid := 0
+	entry := make([]byte, indexEntrySize)
+	for valid < entries && valid < len(records) {
+		_, err = store.indexFile.ReadAt(entry, int64(valid)*indexEntrySize)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(entry, indexEntry(records[valid])) {
+			break
+		}
+		valid++
+	}
+
+	if valid == len(records) && info.Size() == int64(valid)*indexEntrySize {
+		return nil
+	}
+
+	fmt.Printf("Rebuilding block index from entry %d\n", valid)
+	err = store.indexFile.Truncate(int64(valid) * indexEntrySize)
+	if err != nil {
+		return err
+	}
+	for _, record := range records[valid:] {
+		_, err = store.indexFile.WriteAt(indexEntry(record), int64(valid)*indexEntrySize)
+		if err != nil {
+			return err
+		}
+		valid++
+	}
+	return store.indexFile.Sync()
+}
+
+func indexEntry(record storedBlock) []byte {
+	entry := make([]byte, indexEntrySize)
+	copy(entry, record.sha[:])
+	binary.BigEndian.PutUint64(entry[32:], uint64(record.offset))
+	binary.BigEndian.PutUint32(entry[40:], record.length)
+	return entry
+}
+
+func readRecord(file *os.File, offset int64) (Block, uint32, error) {
+	var block Block
+	header := make([]byte, recordHeader)
+	n, err := file.ReadAt(header, offset)
+	if n == 0 && err == io.EOF {
+		return block, 0, io.EOF
+	}
+	if err != nil {
+		return block, 0, err
+	}
+	if binary.BigEndian.Uint32(header) != recordMagic {
+		return block, 0, errors.New("bad record magic")
+	}
+
+	length := binary.BigEndian.Uint32(header[4:])
+	if length > maxRecordSize {
+		return block, 0, errors.New("bad record length")
+	}
+	payload := make([]byte, length)
+	_, err = file.ReadAt(payload, offset+recordHeader)
+	if err != nil {
+		return block, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[8:]) {
+		return block, 0, errors.New("bad record checksum")
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&block)
+	return block, length, err
+}
+
+// Appends a block to the store.  The block is durable once Put
+// returns without an error.
+func (store *BlockStore) Put(block Block) error {
+	sha := block.Hash()
+	if _, ok := store.offsets[sha]; ok {
+		return nil
+	}
+
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(&block)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, recordHeader, recordHeader+payload.Len())
+	binary.BigEndian.PutUint32(record, recordMagic)
+	binary.BigEndian.PutUint32(record[4:], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(record[8:], crc32.ChecksumIEEE(payload.Bytes()))
+	record = append(record, payload.Bytes()...)
+
+	_, err = store.dataFile.WriteAt(record, store.size)
+	if err != nil {
+		return err
+	}
+	err = store.dataFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	entry := indexEntry(storedBlock{sha, store.size, uint32(payload.Len()), block})
+	_, err = store.indexFile.WriteAt(entry, store.entries*indexEntrySize)
+	if err != nil {
+		return err
+	}
+	err = store.indexFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	store.offsets[sha] = store.size
+	store.entries++
+	store.size += int64(len(record))
+	return nil
+}
+
+// Reads a single block from the store using the index.
+func (store *BlockStore) Get(sha SHA) (Block, error) {
+	offset, ok := store.offsets[sha]
+	if !ok {
+		return Block{}, errors.New("block not in store")
+	}
+	block, _, err := readRecord(store.dataFile, offset)
+	return block, err
+}
+
+func (store *BlockStore) Close() error {
+	dataErr := store.dataFile.Close()
+	indexErr := store.indexFile.Close()
+	if dataErr != nil {
+		return dataErr
+	}
+	return indexErr
+}
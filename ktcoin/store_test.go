@@ -0,0 +1,162 @@
+package ktcoin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReopenBlockChain(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	bc, err := OpenBlockChain(dir, testChainParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		prevHash := bc.latestBlock
+		block := mineTestBlock(bc, prevHash, []Transaction{testCoinbase(key, prevHash)})
+		if err := bc.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tip := bc.latestBlock
+	bc.store.Close()
+
+	reopened, err := OpenBlockChain(dir, testChainParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.store.Close()
+	if reopened.latestBlock != tip {
+		t.Error("reopened chain has a different tip")
+	}
+	if balance(reopened.GetOpenInputs(AddressFromKey(key.PublicKey))) != 75 {
+		t.Error("reopened chain did not rebuild open transactions")
+	}
+	if _, err := reopened.store.Get(tip); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBlockStoreTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bc := newTestBlockChain()
+
+	store, _, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := mineTestBlock(&bc, bc.latestBlock, []Transaction{testCoinbase(key, bc.latestBlock)})
+	if err := store.Put(first); err != nil {
+		t.Fatal(err)
+	}
+	second := mineTestBlock(&bc, first.Hash(), []Transaction{testCoinbase(key, first.Hash())})
+	if err := store.Put(second); err != nil {
+		t.Fatal(err)
+	}
+	size := store.size
+	store.Close()
+
+	// Simulate a crash partway through writing the second record,
+	// after its index entry was written.
+	dataPath := filepath.Join(dir, blockFileName)
+	if err := os.Truncate(dataPath, size-10); err != nil {
+		t.Fatal(err)
+	}
+
+	store, blocks, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].Hash() != first.Hash() {
+		t.Fatal("expected only the first block to survive")
+	}
+	indexInfo, _ := os.Stat(filepath.Join(dir, indexFileName))
+	if indexInfo.Size() != indexEntrySize {
+		t.Error("index was not repaired:", indexInfo.Size())
+	}
+
+	// The store keeps working after recovery.
+	if err := store.Put(second); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, blocks, err = OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if len(blocks) != 2 || blocks[1].Hash() != second.Hash() {
+		t.Error("block written after recovery was lost")
+	}
+}
+
+func TestBlockStoreUnindexedRecord(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bc := newTestBlockChain()
+
+	store, _, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := mineTestBlock(&bc, bc.latestBlock, []Transaction{testCoinbase(key, bc.latestBlock)})
+	second := mineTestBlock(&bc, first.Hash(), []Transaction{testCoinbase(key, first.Hash())})
+	for _, block := range []Block{first, second} {
+		if err := store.Put(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	// Simulate a crash after the second record was written but before
+	// its index entry was.
+	indexPath := filepath.Join(dir, indexFileName)
+	if err := os.Truncate(indexPath, indexEntrySize); err != nil {
+		t.Fatal(err)
+	}
+
+	store, blocks, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if len(blocks) != 2 || blocks[0].Hash() != first.Hash() || blocks[1].Hash() != second.Hash() {
+		t.Fatal("expected both blocks to be found")
+	}
+	indexInfo, _ := os.Stat(indexPath)
+	if indexInfo.Size() != 2*indexEntrySize {
+		t.Error("index was not repaired:", indexInfo.Size())
+	}
+	if _, err := store.Get(second.Hash()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreFailureLeavesChainUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bc, err := OpenBlockChain(dir, testChainParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevHash := bc.latestBlock
+	block := mineTestBlock(bc, prevHash, []Transaction{testCoinbase(key, prevHash)})
+
+	// A block that can't be written isn't connected either.
+	bc.store.Close()
+	if err := bc.addBlock(block); err == nil {
+		t.Fatal("accepted a block that could not be stored")
+	}
+	if bc.latestBlock != prevHash || len(bc.utxos) != 0 {
+		t.Error("chain changed although the block was not stored")
+	}
+	if _, ok := bc.blocks[block.Hash()]; ok {
+		t.Error("kept a block that was not stored")
+	}
+}
@@ -0,0 +1,165 @@
+package ktcoin
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sync/atomic"
+)
+
+// The most blocks a peer sends in reply to one GetBlocks call.  A node
+// far behind catches up a batch at a time, so however long the chain
+// gets, it never holds more than one batch it hasn't connected yet.
+const MaxSyncBatch = 500
+
+// How many of the most recent blocks a locator lists one by one before
+// it starts skipping.
+const locatorDenseBlocks = 10
+
+type LocatorRequest struct {
+	from            SHA
+	callbackChannel chan []SHA
+}
+
+func (req LocatorRequest) rpcHandle(server *BlockChainServer) {
+	req.callbackChannel <- server.blockchain.locator(req.from)
+}
+
+type GetBlocksRequest struct {
+	locator         []SHA
+	callbackChannel chan []Block
+}
+
+func (req GetBlocksRequest) rpcHandle(server *BlockChainServer) {
+	req.callbackChannel <- server.blockchain.blocksAfter(req.locator, MaxSyncBatch)
+}
+
+// Describes the chain ending at sha to a peer, so that it can find the
+// last block we have in common.  The locator lists sha and the most
+// recent of its ancestors one by one, then ancestors twice as far
+// apart at each step, and always ends with the genesis block, so it
+// stays short however long the chain is.
+func (bc *BlockChain) locator(sha SHA) []SHA {
+	locator := make([]SHA, 0)
+	meta, ok := bc.index[sha]
+	step := 1
+	for ok {
+		locator = append(locator, sha)
+		if meta.height == 0 {
+			break
+		}
+		if len(locator) >= locatorDenseBlocks {
+			step *= 2
+		}
+		for i := 0; i < step && meta.height > 0; i++ {
+			sha = meta.parent
+			meta = bc.index[sha]
+		}
+	}
+	return locator
+}
+
+// Returns up to limit blocks of the main chain, in order, following
+// the first block in the locator that's on it.  If none are, the
+// blocks follow the genesis block, which every peer shares.
+func (bc *BlockChain) blocksAfter(locator []SHA, limit int) []Block {
+	start := 0
+	for _, sha := range locator {
+		if bc.onMainChain(sha) {
+			start = bc.index[sha].height
+			break
+		}
+	}
+	blocks := make([]Block, 0)
+	for height := start + 1; height < len(bc.mainChain) && len(blocks) < limit; height++ {
+		blocks = append(blocks, bc.blocks[bc.mainChain[height]])
+	}
+	return blocks
+}
+
+// Brings the local chain up to date with each connected peer.  A node
+// syncs whenever it connects to a peer and whenever it receives a block
+// whose parent it has never seen.  Only one sync runs at a time.
+func (s *BlockChainServer) syncBlocks() {
+	if !atomic.CompareAndSwapInt32(&s.syncing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.syncing, 0)
+
+	synced := false
+	nodes := s.conns.Connected()
+	for _, node := range nodes {
+		err := s.conns.Do(node, func(client *rpc.Client) error {
+			return s.syncFrom(client)
+		})
+		if err != nil {
+			fmt.Printf("Sync with %s failed: %v\n", node, err)
+			continue
+		}
+		synced = true
+	}
+	if !synced && len(nodes) > 0 {
+		fmt.Println("Could not sync with any known node.")
+	}
+}
+
+// Asks a peer for its tip, and if we don't have it, fetches the blocks
+// we're missing in batches.  Each request carries a locator for the
+// last block we received, and the peer replies with the blocks of its
+// main chain that follow our last block in common, oldest first.
+// Each batch is connected before the next is asked for.
+func (s *BlockChainServer) syncFrom(client *rpc.Client) error {
+	var tip SHA
+	err := callPeer(client, "BlockChainServer.GetTip", true, &tip)
+	if err != nil {
+		return err
+	}
+	if s.hasBlock(tip) {
+		return nil
+	}
+
+	tipChannel := make(chan SHA)
+	s.requests <- GetTipRequest{tipChannel}
+	from := <-tipChannel
+	fetched := 0
+	for {
+		locatorChannel := make(chan []SHA)
+		s.requests <- LocatorRequest{from, locatorChannel}
+		var blocks []Block
+		err = callPeer(client, "BlockChainServer.GetBlocks", <-locatorChannel, &blocks)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			break
+		}
+		if len(blocks) > MaxSyncBatch {
+			return fmt.Errorf("peer sent %d blocks, more than %d", len(blocks), MaxSyncBatch)
+		}
+		// After the first batch, each one carries on from the
+		// last.  If it doesn't, the peer's chain changed under us,
+		// and the next sync starts over from our new tip.
+		if fetched > 0 && blocks[0].PrevHash != from {
+			return errors.New("peer's chain changed during sync")
+		}
+
+		for _, block := range blocks {
+			callbackChannel := make(chan error, 1)
+			s.requests <- NewBlockNotice{block, callbackChannel}
+			err = <-callbackChannel
+			if err != nil {
+				return err
+			}
+		}
+		fetched += len(blocks)
+		from = blocks[len(blocks)-1].Hash()
+		fmt.Printf("Fetched %d blocks\n", fetched)
+	}
+	return nil
+}
+
+func (s *BlockChainServer) hasBlock(sha SHA) bool {
+	cb := make(chan *Block)
+	s.requests <- GetBlockRequest{sha, cb}
+	return <-cb != nil
+}
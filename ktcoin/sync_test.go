@@ -0,0 +1,114 @@
+package ktcoin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+// Mines n blocks on the tip of bc, each paying a coinbase to key.
+func extendTestChain(t *testing.T, bc *BlockChain, key *rsa.PrivateKey, n int) {
+	for i := 0; i < n; i++ {
+		prevHash := bc.latestBlock
+		block := mineTestBlock(bc, prevHash, []Transaction{testCoinbase(key, prevHash)})
+		if err := bc.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLocator(t *testing.T) {
+	bc := newTestBlockChain()
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	extendTestChain(t, &bc, key, 40)
+
+	locator := bc.locator(bc.latestBlock)
+	if locator[0] != bc.latestBlock || locator[len(locator)-1] != bc.mainChain[0] {
+		t.Fatal("locator does not run from the tip to the genesis block")
+	}
+	// Ten blocks one by one, then skipping 2, 4, 8 and 16.
+	heights := []int{40, 39, 38, 37, 36, 35, 34, 33, 32, 31, 29, 25, 17, 1, 0}
+	if len(locator) != len(heights) {
+		t.Fatalf("got %d locator hashes, want %d", len(locator), len(heights))
+	}
+	for i, height := range heights {
+		if locator[i] != bc.mainChain[height] {
+			t.Errorf("locator hash %d is not the block at height %d", i, height)
+		}
+	}
+}
+
+func TestBlocksAfter(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ours := newTestBlockChain()
+	extendTestChain(t, &ours, key, 3)
+	theirs := newTestBlockChain()
+	for _, sha := range ours.mainChain[1:] {
+		if err := theirs.addBlock(ours.blocks[sha]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extendTestChain(t, &theirs, key, 5)
+	// A block of our own that the peer has never seen.
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+	extendTestChain(t, &ours, other, 1)
+
+	blocks := theirs.blocksAfter(ours.locator(ours.latestBlock), 3)
+	if len(blocks) != 3 {
+		t.Fatalf("got %d blocks, want 3", len(blocks))
+	}
+	for i, block := range blocks {
+		if block.Hash() != theirs.mainChain[4+i] {
+			t.Errorf("block %d does not follow the last block in common", i)
+		}
+	}
+
+	// A locator with nothing in common still gets the chain from the
+	// genesis block.
+	blocks = theirs.blocksAfter([]SHA{{1}}, MaxSyncBatch)
+	if len(blocks) != 8 || blocks[0].Hash() != theirs.mainChain[1] {
+		t.Error("expected the whole chain after the genesis block")
+	}
+	if len(theirs.blocksAfter(theirs.locator(theirs.latestBlock), MaxSyncBatch)) != 0 {
+		t.Error("sent blocks to a peer that's up to date")
+	}
+}
+
+func TestSyncFrom(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	peerChain := newTestBlockChain()
+	extendTestChain(t, &peerChain, key, 2)
+	localChain := newTestBlockChain()
+	for _, sha := range peerChain.mainChain[1:] {
+		if err := localChain.addBlock(peerChain.blocks[sha]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The chains fork, and the peer's branch is more than two
+	// batches long.
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+	extendTestChain(t, &localChain, other, 2)
+	extendTestChain(t, &peerChain, key, 2*MaxSyncBatch+10)
+
+	peer := newTestServer(t, &peerChain)
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("BlockChainServer", peer)
+	clientConn, serverConn := net.Pipe()
+	go rpcServer.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	local := newTestServer(t, &localChain)
+	if err := local.syncFrom(client); err != nil {
+		t.Fatal(err)
+	}
+	tip, height := local.blockchain.Tip()
+	if tip != peerChain.latestBlock || height != 2*MaxSyncBatch+12 {
+		t.Errorf("synced to height %d, not the peer's tip", height)
+	}
+	if err := local.syncFrom(client); err != nil {
+		t.Error("syncing again failed:", err)
+	}
+}
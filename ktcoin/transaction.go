@@ -1,117 +1,253 @@
 package ktcoin
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 )
 
-// A transaction consists of inputs (the previous transactions where
-//  the current owner received coins) and outputs (a map of public
-//  keys to how much they are allocated of the pooled input
-//  transaction coins).  To be valid, a transaction must obey several
-//  properties:
+// A transaction consists of inputs (outputs of previous transactions
+//  owned by the sender) and an ordered list of outputs (how much of
+//  the pooled input coins each public key is allocated).  To be
+//  valid, a transaction must obey several properties:
 //
-//  1. None of the input transactions have been used as an input
+//  1. None of the inputs have been spent by another transaction
 //  already.
 
-//  2. The total number of coins in the inputs equals the number of
-//  coins in the output, except for one special transaction per block
-//  which creates new coins.
+//  2. The total number of coins in the outputs doesn't exceed the
+//  number of coins in the inputs, except for one special transaction
+//  per block which creates new coins.  Any difference is a fee paid to
+//  the miner.
 
-//  3. The signature must match the owner of all the input
-//     transactions (they all have to be owned by the same key)
+//  3. Every input must be owned by one of the senders, and every
+//     sender must own at least one input and sign the transaction.
+//     Signatures[i] is made by Senders[i].
 type Transaction struct {
-	Inputs    []SHA
-	Sender    rsa.PublicKey
-	Recipient rsa.PublicKey
-	Outputs   map[string]int
-	Signature []byte
+	Inputs     []OutPoint
+	Senders    []rsa.PublicKey
+	Outputs    []TxOut
+	Signatures [][]byte
 }
 
-func (t Transaction) String() string {
-	return fmt.Sprintf("<Transaction %x>", t.Hash())
+// An OutPoint identifies a single output of a transaction: the hash
+// of the transaction and the output's position in its Outputs.
+type OutPoint struct {
+	Hash  SHA
+	Index uint32
 }
 
-// Computes the hash of a transaction by concatenating the hashes of
-// the transaction's inputs with the key of the transaction's
-// recipient.
-func (t *Transaction) Hash() SHA {
-	toHash := make([]byte, 0)
-	for _, input := range t.Inputs {
-		toHash = append(toHash, input[:]...)
-	}
+func (op OutPoint) String() string {
+	return fmt.Sprintf("%x:%d", op.Hash, op.Index)
+}
 
-	for key, _ := range t.Outputs {
-		toHash = append(toHash, []byte(key)...)
-	}
+// A TxOut pays Amount coins to an address.  Only the owner of the key
+// the address was derived from can spend it.
+type TxOut struct {
+	Address Address
+	Amount  int
+}
 
-	toHash = append(toHash, t.Signature...)
+// An open output that can be spent in a new transaction, along with
+// its amount and the private key of its owner.
+type SpendableOutput struct {
+	OutPoint OutPoint
+	Amount   int
+	Owner    *rsa.PrivateKey
+}
 
-	hash := sha256.Sum256(toHash)
-	return hash
+// A Payment requested of NewTransaction: Amount coins to Recipient.
+type Payment struct {
+	Recipient Address
+	Amount    int
 }
 
-func bytesToSign(recipient rsa.PublicKey, inputHashes []SHA) (SHA, error) {
-	bytesToHash, err := x509.MarshalPKIXPublicKey(&recipient)
-	if err != nil {
-		var empty SHA
-		fmt.Println("marshaling error")
-		return empty, err
-	}
-	for _, inputHash := range inputHashes {
-		bytesToHash = append(bytesToHash, inputHash[:]...)
+// The coinbase transaction that starts each block has a single fake
+// input pointing at the previous block, which makes every coinbase
+// unique.
+const CoinbaseIndex = math.MaxUint32
+
+func coinbaseInput(prevHash SHA) OutPoint {
+	return OutPoint{prevHash, CoinbaseIndex}
+}
+
+// Creates a coinbase transaction paying amount new coins to address in
+// the block following prevHash.  A coinbase spends nothing, so it has
+// no senders and isn't signed, and mining doesn't reveal the miner's
+// public key.
+func NewCoinbase(address Address, prevHash SHA, amount int) *Transaction {
+	return &Transaction{
+		[]OutPoint{coinbaseInput(prevHash)},
+		nil,
+		[]TxOut{{address, amount}},
+		nil,
 	}
-	return sha256.Sum256(bytesToHash), nil
 }
 
-// Creates a new transaction struct, verifying that the input
-// transactions have enough funds and sending any remaining funds from
-// the input transactions back to the sender.
-func NewTransaction(inputs []Transaction, sender *rsa.PrivateKey, recipient rsa.PublicKey, amount int) (*Transaction, error) {
-	senderKeyString := publicKeyString(sender.PublicKey)
-	recipientKeyString := publicKeyString(recipient)
+func (t Transaction) String() string {
+	return fmt.Sprintf("<Transaction %x>", t.Hash())
+}
 
-	inputTotal := 0
-	for _, inputTx := range inputs {
-		inputTotal += inputTx.Outputs[senderKeyString]
+// Computes the hash of a transaction from its canonical encoding,
+// which covers the inputs, senders, every output with its amount,
+// and the signatures.
+func (t *Transaction) Hash() SHA {
+	return sha256.Sum256(t.Encode())
+}
+
+// Identifies the network a transaction was signed for, so that a
+// signature made on one network can't be replayed on another.
+const NetworkMagic = 0x6b74636e // "ktcn"
+
+// The digest signed by each sender: the network magic followed by the
+// canonical encoding of everything in the transaction except the
+// signatures themselves.  This commits the signatures to the version,
+// every input, every sender and every output with its amount, so a
+// relaying node can't alter any of them.
+func (t *Transaction) signingHash() SHA {
+	var e encoder
+	e.uint32(NetworkMagic)
+	e.transactionBody(t)
+	return sha256.Sum256(e.buf.Bytes())
+}
+
+// Signs the transaction with the private key of each sender, in
+// order.  The senders' public keys become part of the transaction.
+func (t *Transaction) Sign(senders ...*rsa.PrivateKey) error {
+	t.Senders = make([]rsa.PublicKey, 0, len(senders))
+	for _, sender := range senders {
+		t.Senders = append(t.Senders, sender.PublicKey)
+	}
+	hashed := t.signingHash()
+	t.Signatures = make([][]byte, 0, len(senders))
+	for _, sender := range senders {
+		signature, err := rsa.SignPKCS1v15(rand.Reader, sender, crypto.SHA256, hashed[:])
+		if err != nil {
+			return err
+		}
+		t.Signatures = append(t.Signatures, signature)
 	}
+	return nil
+}
 
-	change := inputTotal - amount
+// Checks that the transaction was signed by every one of its senders
+// and hasn't been modified since.
+func (t *Transaction) VerifySignatures() error {
+	if len(t.Senders) == 0 {
+		return errors.New("missing sender key")
+	}
+	if len(t.Signatures) != len(t.Senders) {
+		return fmt.Errorf("%d signatures for %d senders", len(t.Signatures), len(t.Senders))
+	}
+	hashed := t.signingHash()
+	seen := make(map[string]bool)
+	for i := range t.Senders {
+		if t.Senders[i].N == nil {
+			return errors.New("missing sender key")
+		}
+		key := publicKeyString(t.Senders[i])
+		if seen[key] {
+			return errors.New("sender is listed twice")
+		}
+		seen[key] = true
+		err := rsa.VerifyPKCS1v15(&t.Senders[i], crypto.SHA256, hashed[:], t.Signatures[i])
+		if err != nil {
+			return errors.New("invalid signature")
+		}
+	}
+	return nil
+}
 
-	outputs := make(map[string]int)
-	outputs[recipientKeyString] = amount
+// Creates a new transaction spending the given open inputs (and
+// their amounts) owned by the sender.  Each payment becomes an output,
+// in order, fee coins are left for the miner, and any remaining funds
+// from the inputs are sent back to the sender's address in a single
+// change output at the end.
+func NewTransaction(inputs map[OutPoint]int, sender *rsa.PrivateKey, payments []Payment, fee int) (*Transaction, error) {
+	spendable := make([]SpendableOutput, 0, len(inputs))
+	for outPoint, amount := range inputs {
+		spendable = append(spendable, SpendableOutput{outPoint, amount, sender})
+	}
+	return NewMultiKeyTransaction(spendable, payments, AddressFromKey(sender.PublicKey), fee)
+}
 
-	if change > 0 {
-		outputs[senderKeyString] = change
+// Like NewTransaction, but the inputs may be owned by several keys,
+// each of which signs the transaction.  Change goes to the change
+// address.
+func NewMultiKeyTransaction(inputs []SpendableOutput, payments []Payment, change Address, fee int) (*Transaction, error) {
+	if fee < 0 {
+		return nil, fmt.Errorf("invalid fee %d", fee)
 	}
 
-	inputHashes := make([]SHA, 0)
+	inputTotal := 0
+	owners := make(map[OutPoint]*rsa.PrivateKey)
+	outPoints := make([]OutPoint, 0, len(inputs))
 	for _, input := range inputs {
-		hash := input.Hash()
-		inputHashes = append(inputHashes, hash)
+		if _, ok := owners[input.OutPoint]; ok {
+			return nil, fmt.Errorf("input %v is spent twice", input.OutPoint)
+		}
+		inputTotal += input.Amount
+		owners[input.OutPoint] = input.Owner
+		outPoints = append(outPoints, input.OutPoint)
+	}
+	sortOutPoints(outPoints)
+
+	// Each key signs once, in the order its first input appears.
+	// The same key may be passed in more than once, so keys are told
+	// apart by address.
+	senders := make([]*rsa.PrivateKey, 0)
+	signing := make(map[Address]bool)
+	for _, outPoint := range outPoints {
+		owner := owners[outPoint]
+		address := AddressFromKey(owner.PublicKey)
+		if !signing[address] {
+			signing[address] = true
+			senders = append(senders, owner)
+		}
 	}
 
-	hashed, err := bytesToSign(recipient, inputHashes)
-	if err != nil {
-		return nil, err
+	outputs := make([]TxOut, 0, len(payments)+1)
+	paymentTotal := 0
+	for _, payment := range payments {
+		if payment.Amount <= 0 {
+			return nil, fmt.Errorf("invalid payment amount %d", payment.Amount)
+		}
+		outputs = append(outputs, TxOut{payment.Recipient, payment.Amount})
+		paymentTotal += payment.Amount
+	}
+
+	changeAmount := inputTotal - paymentTotal - fee
+	if changeAmount < 0 {
+		return nil, insufficientFunds(paymentTotal+fee, inputTotal)
+	}
+	if changeAmount > 0 {
+		outputs = append(outputs, TxOut{change, changeAmount})
 	}
 
-	signature, err := rsa.SignPKCS1v15(rand.Reader, sender, crypto.SHA256, hashed[:])
+	tx := &Transaction{
+		outPoints,
+		nil,
+		outputs,
+		nil,
+	}
+	err := tx.Sign(senders...)
 	if err != nil {
 		return nil, err
 	}
+	return tx, nil
+}
 
-	senderPubKey := sender.PublicKey
-
-	return &Transaction{
-		inputHashes,
-		senderPubKey,
-		recipient,
-		outputs,
-		signature,
-	}, nil
+func sortOutPoints(outPoints []OutPoint) {
+	sort.Slice(outPoints, func(i, j int) bool {
+		c := bytes.Compare(outPoints[i].Hash[:], outPoints[j].Hash[:])
+		if c != 0 {
+			return c < 0
+		}
+		return outPoints[i].Index < outPoints[j].Index
+	})
 }
@@ -1,10 +1,9 @@
 package ktcoin
 
 import (
-	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
+	"errors"
 	"testing"
 )
 
@@ -12,32 +11,195 @@ func TestNewTransaction(t *testing.T) {
 	sender, _ := rsa.GenerateKey(rand.Reader, 2048)
 	recipient, _ := rsa.GenerateKey(rand.Reader, 2048)
 
-	// Build a dummy transaction to serve as input
-	dummyOutputs := make(map[string]int)
-	// Give sender 2 coins to send
-	dummyOutputs[publicKeyString(sender.PublicKey)] = 25
-	bytesToSign := sha256.Sum256([]byte("dummy data"))
-	dummySignature, _ := rsa.SignPKCS1v15(rand.Reader, sender, crypto.SHA256, bytesToSign[:])
-	dummyTransaction := Transaction{[]SHA{}, sender.PublicKey, recipient.PublicKey, dummyOutputs, dummySignature}
-
-	inputs := []Transaction{
-		dummyTransaction,
+	// Give sender two open outputs worth 25 coins in total to send
+	var dummyTxHash SHA
+	dummyTxHash[0] = 1
+	inputs := map[OutPoint]int{
+		{dummyTxHash, 1}: 20,
+		{dummyTxHash, 0}: 5,
 	}
 
-	tx, err := NewTransaction(inputs, sender, recipient.PublicKey, 1)
+	tx, err := NewTransaction(inputs, sender, []Payment{{AddressFromKey(recipient.PublicKey), 1}}, 0)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	dummyTxHash := dummyTransaction.Hash()
-
-	if len(tx.Inputs) != 1 || tx.Inputs[0] != dummyTxHash {
+	// Inputs are in a deterministic order.
+	if len(tx.Inputs) != 2 || tx.Inputs[0] != (OutPoint{dummyTxHash, 0}) || tx.Inputs[1] != (OutPoint{dummyTxHash, 1}) {
 		t.Fail()
 	}
 
 	// Check for change.
-	if tx.Outputs[publicKeyString(sender.PublicKey)] != 24 || tx.Outputs[publicKeyString(recipient.PublicKey)] != 1 {
+	if len(tx.Outputs) != 2 ||
+		tx.Outputs[0] != (TxOut{AddressFromKey(recipient.PublicKey), 1}) ||
+		tx.Outputs[1] != (TxOut{AddressFromKey(sender.PublicKey), 24}) {
 		t.Fail()
 	}
+
+	// The inputs have to cover the payments and the fee.
+	if _, err := NewTransaction(inputs, sender, []Payment{{AddressFromKey(recipient.PublicKey), 24}}, 2); !errors.Is(err, ErrInsufficientFunds) {
+		t.Error("expected insufficient funds, got", err)
+	}
+}
+
+func TestNewTransactionManyRecipients(t *testing.T) {
+	bc := newTestBlockChain()
+	sender, _ := rsa.GenerateKey(rand.Reader, 2048)
+	coinbase := testCoinbase(sender, bc.latestBlock)
+	err := bc.addNextBlock(10000, 0, []Transaction{coinbase})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payments := make([]Payment, 0)
+	for i := 1; i <= 5; i++ {
+		recipient, _ := rsa.GenerateKey(rand.Reader, 2048)
+		payments = append(payments, Payment{AddressFromKey(recipient.PublicKey), i})
+	}
+
+	tx, err := NewTransaction(outputsOf(&coinbase), sender, payments, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One output per payment, in order, plus a single change output.
+	if len(tx.Outputs) != len(payments)+1 {
+		t.Fatal("wrong number of outputs:", len(tx.Outputs))
+	}
+	for i, payment := range payments {
+		if tx.Outputs[i] != (TxOut{payment.Recipient, payment.Amount}) {
+			t.Error("wrong output for payment", i)
+		}
+	}
+	if tx.Outputs[len(payments)] != (TxOut{AddressFromKey(sender.PublicKey), 10}) {
+		t.Error("wrong change output:", tx.Outputs[len(payments)])
+	}
+	if err := bc.Verify(tx); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := NewTransaction(outputsOf(&coinbase), sender, []Payment{{AddressFromKey(sender.PublicKey), 0}}, 0); err == nil {
+		t.Error("accepted a zero payment")
+	}
+}
+
+func TestSignatureCoversOutputs(t *testing.T) {
+	bc := newTestBlockChain()
+	sender, _ := rsa.GenerateKey(rand.Reader, 2048)
+	recipient, _ := rsa.GenerateKey(rand.Reader, 2048)
+	thief, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	coinbase := testCoinbase(sender, bc.latestBlock)
+	err := bc.addNextBlock(10000, 0, []Transaction{coinbase})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTx := func() *Transaction {
+		tx, err := NewTransaction(outputsOf(&coinbase), sender, []Payment{{AddressFromKey(recipient.PublicKey), 10}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	if err := bc.Verify(newTx()); err != nil {
+		t.Fatal("untampered transaction should verify:", err)
+	}
+
+	thiefAddress := AddressFromKey(thief.PublicKey)
+	tamperings := map[string]func(tx *Transaction){
+		"changed amount": func(tx *Transaction) {
+			tx.Outputs[0].Amount = 11
+			tx.Outputs[1].Amount = 14
+		},
+		"redirected change": func(tx *Transaction) {
+			tx.Outputs[1].Address = thiefAddress
+		},
+		"added output": func(tx *Transaction) {
+			tx.Outputs[1].Amount -= 5
+			tx.Outputs = append(tx.Outputs, TxOut{thiefAddress, 5})
+		},
+		"reordered outputs": func(tx *Transaction) {
+			tx.Outputs[0], tx.Outputs[1] = tx.Outputs[1], tx.Outputs[0]
+		},
+		"changed sender": func(tx *Transaction) {
+			tx.Senders[0] = thief.PublicKey
+		},
+		"added sender": func(tx *Transaction) {
+			tx.Senders = append(tx.Senders, thief.PublicKey)
+			tx.Signatures = append(tx.Signatures, tx.Signatures[0])
+		},
+		"missing signature": func(tx *Transaction) {
+			tx.Signatures = nil
+		},
+	}
+	for name, tamper := range tamperings {
+		tx := newTx()
+		tamper(tx)
+		if err := bc.Verify(tx); err == nil {
+			t.Errorf("%s: tampered transaction was accepted", name)
+		}
+	}
+}
+
+func TestEverySenderOwnsAnInput(t *testing.T) {
+	bc := newTestBlockChain()
+	sender, _ := rsa.GenerateKey(rand.Reader, 2048)
+	stranger, _ := rsa.GenerateKey(rand.Reader, 2048)
+	coinbase := testCoinbase(sender, bc.latestBlock)
+	if err := bc.addNextBlock(10000, 0, []Transaction{coinbase}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Properly signed by both keys, but the stranger owns nothing.
+	tx := Transaction{[]OutPoint{{coinbase.Hash(), 0}}, nil, []TxOut{{AddressFromKey(stranger.PublicKey), 25}}, nil}
+	tx.Sign(sender, stranger)
+	if err := bc.Verify(&tx); err == nil {
+		t.Error("accepted a sender that owns none of the inputs")
+	}
+	tx.Sign(sender, sender)
+	if err := bc.Verify(&tx); err == nil {
+		t.Error("accepted a sender listed twice")
+	}
+	tx.Sign(sender)
+	if err := bc.Verify(&tx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMultiKeyTransactionSignsOncePerKey(t *testing.T) {
+	alice, _ := rsa.GenerateKey(rand.Reader, 1024)
+	bob, _ := rsa.GenerateKey(rand.Reader, 1024)
+	aliceAgain := *alice
+	inputs := []SpendableOutput{
+		{OutPoint{SHA{1}, 0}, 10, alice},
+		{OutPoint{SHA{2}, 0}, 10, bob},
+		{OutPoint{SHA{3}, 0}, 10, &aliceAgain},
+	}
+	tx, err := NewMultiKeyTransaction(inputs, []Payment{{AddressFromKey(bob.PublicKey), 30}}, AddressFromKey(alice.PublicKey), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Senders) != 2 {
+		t.Errorf("%d senders for two keys", len(tx.Senders))
+	}
+	if err := tx.VerifySignatures(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSigningHashGolden(t *testing.T) {
+	tx := goldenTransaction()
+	hash := tx.signingHash()
+	if hash.String() != goldenSigningHash {
+		t.Errorf("signing hash changed: got %s, want %s", hash.String(), goldenSigningHash)
+	}
+
+	// The signature itself is not part of what's signed.
+	tx.Signatures = [][]byte{[]byte("another signature")}
+	if tx.signingHash() != hash {
+		t.Error("signing hash depends on the signature")
+	}
 }
@@ -0,0 +1,54 @@
+package ktcoin
+
+import (
+	"fmt"
+)
+
+// The set of unspent transaction outputs: every output on the main
+// chain that hasn't yet been used as an input.  A transaction is only
+// valid if every one of its inputs is in this set.
+type UTXOSet map[OutPoint]TxOut
+
+func NewUTXOSet() UTXOSet {
+	return make(UTXOSet)
+}
+
+func (set UTXOSet) Add(outPoint OutPoint, out TxOut) {
+	set[outPoint] = out
+}
+
+// Adds every output of a transaction to the set.
+func (set UTXOSet) AddTransaction(t *Transaction) {
+	hash := t.Hash()
+	for i, out := range t.Outputs {
+		set.Add(OutPoint{hash, uint32(i)}, out)
+	}
+}
+
+// Removes an output from the set, returning it so the spend can be
+// undone later.
+func (set UTXOSet) Spend(outPoint OutPoint) (TxOut, error) {
+	out, ok := set[outPoint]
+	if !ok {
+		return out, fmt.Errorf("output %v is not open", outPoint)
+	}
+	delete(set, outPoint)
+	return out, nil
+}
+
+func (set UTXOSet) Lookup(outPoint OutPoint) (TxOut, bool) {
+	out, ok := set[outPoint]
+	return out, ok
+}
+
+// Returns the open outputs paying to the given address, along with
+// their amounts.
+func (set UTXOSet) ForAddress(address Address) map[OutPoint]int {
+	found := make(map[OutPoint]int)
+	for outPoint, out := range set {
+		if out.Address == address {
+			found[outPoint] = out.Amount
+		}
+	}
+	return found
+}
@@ -0,0 +1,209 @@
+package ktcoin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// The version of the wallet file format.  Version 1 wallets stored
+// their keys unencrypted; they're still read, and are encrypted when
+// next saved.
+const WalletVersion = 2
+
+// The size of keys the wallet generates.
+const WalletKeyBits = 2048
+
+// A key held by a wallet, under a label chosen by its owner.
+type WalletKey struct {
+	Label   string
+	Key     *rsa.PrivateKey
+	Created time.Time
+}
+
+// Returns the address that coins sent to the key are paid to.
+func (k *WalletKey) Address() Address {
+	return AddressFromKey(k.Key.PublicKey)
+}
+
+// A Wallet holds many keys, each of which can receive coins.  Spending
+// from a wallet may draw on the open outputs of any of its keys.  The
+// first key also receives the change from sends.  Wallets are saved to
+// path as JSON, which only their owner may read, with every key
+// encrypted under the wallet's passphrase.
+type Wallet struct {
+	path      string
+	keys      []*WalletKey
+	crypto    *keyCrypter
+	encrypted bool
+}
+
+// The JSON form of a wallet file.  Keys are stored as encrypted PEM
+// blocks, in the same form as key files.
+type walletFile struct {
+	Version int             `json:"version"`
+	Keys    []walletKeyJSON `json:"keys"`
+}
+
+type walletKeyJSON struct {
+	Label      string    `json:"label"`
+	Created    time.Time `json:"created"`
+	PrivateKey string    `json:"private_key"`
+}
+
+// Opens the wallet saved at path, or starts a new, empty one if there
+// isn't a file there yet.  The passphrase decrypts the keys of a wallet
+// that's already encrypted; a wallet that isn't yet is encrypted under
+// newPassphrase when it's saved.  Neither is asked for until needed.
+func OpenWallet(path string, passphrase PassphraseFunc, newPassphrase PassphraseFunc) (*Wallet, error) {
+	w := &Wallet{path, []*WalletKey{}, newKeyCrypter(newPassphrase), false}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file walletFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if file.Version != 1 && file.Version != WalletVersion {
+		return nil, fmt.Errorf("%s: unsupported wallet version %d", path, file.Version)
+	}
+	if file.Version == WalletVersion && len(file.Keys) > 0 {
+		w.crypto.passphrase = passphrase
+		w.encrypted = true
+	}
+	for _, k := range file.Keys {
+		key, err := w.crypto.decrypt([]byte(k.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q: %w", path, k.Label, err)
+		}
+		w.keys = append(w.keys, &WalletKey{k.Label, key, k.Created})
+	}
+	return w, nil
+}
+
+// Saves the wallet, replacing the file at its path only once the new
+// contents have been written in full.
+func (w *Wallet) Save() error {
+	file := walletFile{WalletVersion, make([]walletKeyJSON, 0, len(w.keys))}
+	for _, k := range w.keys {
+		encrypted, err := w.crypto.encrypt(k.Key)
+		if err != nil {
+			return err
+		}
+		file.Keys = append(file.Keys, walletKeyJSON{k.Label, k.Created, string(encrypted)})
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = replaceFile(w.path, data, 0600)
+	if err != nil {
+		return err
+	}
+	w.encrypted = true
+	return nil
+}
+
+// Returns true if the wallet's keys are encrypted on disk.
+func (w *Wallet) Encrypted() bool {
+	return w.encrypted
+}
+
+// Returns the wallet's keys, in the order they were added.
+func (w *Wallet) Keys() []*WalletKey {
+	return w.keys
+}
+
+// Returns the key with the given label, or nil.
+func (w *Wallet) Key(label string) *WalletKey {
+	for _, k := range w.keys {
+		if k.Label == label {
+			return k
+		}
+	}
+	return nil
+}
+
+// Generates a new key to receive coins with.  If no label is given,
+// one is made up from the number of keys in the wallet.
+func (w *Wallet) NewKey(label string) (*WalletKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, WalletKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return w.add(label, key)
+}
+
+// Adds the private key in keyFile, such as one written by GenerateKey,
+// to the wallet.  The passphrase is the key file's own, if it's
+// encrypted.
+func (w *Wallet) Import(label string, keyFile string, passphrase PassphraseFunc) (*WalletKey, error) {
+	key, err := LoadKey(keyFile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return w.add(label, key)
+}
+
+// Writes the key with the given label to keyFile, encrypted under the
+// wallet's passphrase, and its public key to keyFile.pub, in the same
+// form as GenerateKey.
+func (w *Wallet) Export(label string, keyFile string) error {
+	k := w.Key(label)
+	if k == nil {
+		return fmt.Errorf("no key labeled %q", label)
+	}
+	return writeKeyFiles(k.Key, keyFile, w.crypto)
+}
+
+func (w *Wallet) add(label string, key *rsa.PrivateKey) (*WalletKey, error) {
+	if label == "" {
+		label = fmt.Sprintf("key%d", len(w.keys)+1)
+	}
+	if w.Key(label) != nil {
+		return nil, fmt.Errorf("the wallet already has a key labeled %q", label)
+	}
+	for _, k := range w.keys {
+		if k.Key.N.Cmp(key.N) == 0 {
+			return nil, fmt.Errorf("the wallet already has this key, labeled %q", k.Label)
+		}
+	}
+	k := &WalletKey{label, key, time.Now().UTC()}
+	w.keys = append(w.keys, k)
+	return k, nil
+}
+
+// Builds a transaction making the given payments from the wallet's
+// open outputs, which are given for each key by label.  The selector
+// picks which outputs to spend.  Change goes to the wallet's first key.
+func (w *Wallet) NewTransaction(open map[string]map[OutPoint]int, payments []Payment, fee int, selector CoinSelector) (*Transaction, error) {
+	if len(w.keys) == 0 {
+		return nil, errors.New("the wallet has no keys")
+	}
+	candidates := make([]SpendableOutput, 0)
+	for _, k := range w.keys {
+		for outPoint, amount := range open[k.Label] {
+			candidates = append(candidates, SpendableOutput{outPoint, amount, k.Key})
+		}
+	}
+	target := fee
+	for _, payment := range payments {
+		target += payment.Amount
+	}
+	inputs, err := selector(candidates, target)
+	if err != nil {
+		return nil, err
+	}
+	return NewMultiKeyTransaction(inputs, payments, w.keys[0].Address(), fee)
+}
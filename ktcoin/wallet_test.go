@@ -0,0 +1,176 @@
+package ktcoin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWalletSaveAndOpen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wallet.json")
+	w, err := OpenWallet(path, nil, testPassphrase("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Keys()) != 0 {
+		t.Fatal("new wallet has keys")
+	}
+	if _, err := w.NewKey("savings"); err != nil {
+		t.Fatal(err)
+	}
+	unlabeled, err := w.NewKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlabeled.Label != "key2" {
+		t.Errorf("got label %q, want key2", unlabeled.Label)
+	}
+	if _, err := w.NewKey("savings"); err == nil {
+		t.Error("accepted a duplicate label")
+	}
+	if err := w.Save(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("wallet file has mode %v, want 0600", info.Mode().Perm())
+	}
+
+	reopened, err := OpenWallet(path, testPassphrase("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.Encrypted() {
+		t.Error("saved wallet is not encrypted")
+	}
+	if len(reopened.Keys()) != 2 {
+		t.Fatalf("got %d keys, want 2", len(reopened.Keys()))
+	}
+	for i, k := range reopened.Keys() {
+		original := w.Keys()[i]
+		if k.Label != original.Label || k.Key.N.Cmp(original.Key.N) != 0 || !k.Created.Equal(original.Created) {
+			t.Errorf("key %d changed when saved", i)
+		}
+	}
+
+	if _, err := OpenWallet(path, testPassphrase("wrong"), nil); !errors.Is(err, ErrWrongPassphrase) {
+		t.Error("expected the wrong passphrase to fail, got", err)
+	}
+}
+
+func TestWalletEncryptsPlaintextWallet(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wallet.json")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	plain := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	file := walletFile{1, []walletKeyJSON{{"old", time.Now().UTC(), string(plain)}}}
+	data, _ := json.Marshal(file)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A wallet from before keys were encrypted opens without a
+	// passphrase, and is encrypted under the new one when saved.
+	w, err := OpenWallet(path, nil, testPassphrase("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Encrypted() || w.Key("old") == nil {
+		t.Fatal("plaintext wallet was not read")
+	}
+	if err := w.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := ioutil.ReadFile(path)
+	if bytes.Contains(saved, []byte("BEGIN RSA PRIVATE KEY")) {
+		t.Error("saved wallet still holds a plaintext key")
+	}
+	reopened, err := OpenWallet(path, testPassphrase("new"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Key("old").Key.N.Cmp(key.N) != 0 {
+		t.Error("key changed when the wallet was encrypted")
+	}
+}
+
+func TestWalletImportExport(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := OpenWallet(filepath.Join(dir, "wallet.json"), nil, testPassphrase("secret"))
+	k, err := w.NewKey("spending")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "id_rsa")
+	if err := w.Export("spending", keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Export("spending", keyFile); err == nil {
+		t.Error("export overwrote an existing key file")
+	}
+	pub, err := LoadPublicKey(keyFile + ".pub")
+	if err != nil || pub.N.Cmp(k.Key.N) != 0 {
+		t.Error("exported the wrong public key:", err)
+	}
+
+	if _, err := w.Import("again", keyFile, testPassphrase("secret")); err == nil {
+		t.Error("imported a key the wallet already has")
+	}
+	other, _ := OpenWallet(filepath.Join(dir, "other.json"), nil, testPassphrase("other"))
+	imported, err := other.Import("imported", keyFile, testPassphrase("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Key.N.Cmp(k.Key.N) != 0 {
+		t.Error("imported a different key")
+	}
+}
+
+func TestWalletSpendsFromEveryKey(t *testing.T) {
+	bc := newTestBlockChain()
+	w, _ := OpenWallet(filepath.Join(t.TempDir(), "wallet.json"), nil, nil)
+	first, _ := w.NewKey("first")
+	second, _ := w.NewKey("second")
+	recipient, _ := w.NewKey("recipient")
+
+	for _, k := range []*WalletKey{first, second} {
+		coinbase := testCoinbase(k.Key, bc.latestBlock)
+		if err := bc.addNextBlock(10000, 0, []Transaction{coinbase}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := make(map[string]map[OutPoint]int)
+	for _, k := range w.Keys() {
+		open[k.Label] = bc.GetOpenInputs(AddressFromKey(k.Key.PublicKey))
+	}
+
+	// Neither key holds enough on its own.
+	tx, err := w.NewTransaction(open, []Payment{{AddressFromKey(recipient.Key.PublicKey), 40}}, 2, SelectLargestFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Senders) != 2 || len(tx.Signatures) != 2 {
+		t.Fatalf("got %d senders and %d signatures, want 2 of each", len(tx.Senders), len(tx.Signatures))
+	}
+	fee, err := bc.verifyTransaction(tx)
+	if err != nil || fee != 2 {
+		t.Fatal("expected a valid transaction paying a fee of 2:", fee, err)
+	}
+	if tx.Outputs[1] != (TxOut{AddressFromKey(first.Key.PublicKey), 8}) {
+		t.Error("change did not go to the first key:", tx.Outputs[1])
+	}
+}
@@ -1,17 +1,54 @@
 package main
 
 import (
-	"github.com/loganmhb/ktcoin/ktcoin"
-	"fmt"
 	"flag"
+	"fmt"
+
+	"github.com/loganmhb/ktcoin/ktcoin"
 )
 
 func main() {
+	defaults := ktcoin.DefaultConfig()
+	configFile := flag.String("config", "", "JSON file of node settings; flags override its values")
+	listen := flag.String("listen", defaults.ListenAddress, "Address to listen for peers and clients on")
+	api := flag.String("api", defaults.APIAddress, "Address to serve the HTTP JSON API on (off if empty)")
+	keyFile := flag.String("key", defaults.KeyFile, "File of the private key that mined coins are paid to")
+	dataDir := flag.String("datadir", defaults.DataDir, "Directory where the block chain is stored")
+	mining := flag.Bool("mine", defaults.Mining, "Mine new blocks")
+	workers := flag.Int("workers", defaults.Workers, "Number of goroutines mining blocks")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: ktcoin [flags] [peer[:port] ...]")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
-	key, err := ktcoin.LoadKey("id_rsa")
-	if err != nil {
-		fmt.Println(err)
-	} else {
-		ktcoin.RunNode([]string{flag.Arg(0), flag.Arg(1)}, key)
+
+	cfg := defaults
+	if *configFile != "" {
+		err := cfg.LoadFile(*configFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 	}
+
+	// Flags given on the command line win over the config file.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddress = *listen
+		case "api":
+			cfg.APIAddress = *api
+		case "key":
+			cfg.KeyFile = *keyFile
+		case "datadir":
+			cfg.DataDir = *dataDir
+		case "mine":
+			cfg.Mining = *mining
+		case "workers":
+			cfg.Workers = *workers
+		}
+	})
+	cfg.Peers = append(cfg.Peers, flag.Args()...)
+
+	ktcoin.RunNode(cfg)
 }